@@ -0,0 +1,527 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Embedded key-value store backend for QuickFS.
+//
+// All nodes of a volume are kept in a single bbolt file. The bucket "meta"
+// maps a node UUID to its gob encoded quickfs.Statbuf, "dirents" maps
+// UUID+name to the child UUID and "data" maps UUID+chunk-index to the
+// file content, split into ChunkSize large chunks. Extended attributes are
+// kept in "xattrs", keyed by UUID+name.
+package boltfs
+
+import "github.com/byte-mug/quickfs"
+import "github.com/nu7hatch/gouuid"
+import bolt "go.etcd.io/bbolt"
+import "bytes"
+import "encoding/binary"
+import "encoding/gob"
+import "io"
+import "os"
+import "syscall"
+import "time"
+
+const ChunkSize = 1<<16
+
+var (
+	bMeta    = []byte("meta")
+	bDirents = []byte("dirents")
+	bData    = []byte("data")
+	bXattrs  = []byte("xattrs")
+)
+
+type FileSystem struct {
+	DB *bolt.DB
+}
+
+// Opens or creates the store at path.
+func Open(path string) (*FileSystem,error) {
+	db,e := bolt.Open(path,0600,&bolt.Options{Timeout:time.Second})
+	if e!=nil { return nil,e }
+	e = db.Update(func(tx *bolt.Tx) error {
+		for _,b := range [][]byte{bMeta,bDirents,bData,bXattrs} {
+			if _,e := tx.CreateBucketIfNotExists(b); e!=nil { return e }
+		}
+		return nil
+	})
+	if e!=nil {
+		db.Close()
+		return nil,e
+	}
+	return &FileSystem{db},nil
+}
+func (fs *FileSystem) Close() error {
+	return fs.DB.Close()
+}
+
+func pathErr(op string,id *uuid.UUID,name string,err error) error {
+	p := id.String()
+	if name!="" { p += "/"+name }
+	return &os.PathError{Op:op,Path:p,Err:err}
+}
+func direntKey(id *uuid.UUID,name string) []byte {
+	k := make([]byte,16,16+len(name))
+	copy(k,id[:])
+	return append(k,name...)
+}
+func chunkKey(id *uuid.UUID,i int64) []byte {
+	k := make([]byte,24)
+	copy(k,id[:])
+	binary.BigEndian.PutUint64(k[16:],uint64(i))
+	return k
+}
+func prefixKeys(b *bolt.Bucket,prefix []byte) (keys [][]byte) {
+	c := b.Cursor()
+	for k,_ := c.Seek(prefix); k!=nil && bytes.HasPrefix(k,prefix); k,_ = c.Next() {
+		keys = append(keys,append([]byte(nil),k...))
+	}
+	return
+}
+
+func getMeta(tx *bolt.Tx,op string,id *uuid.UUID) (*quickfs.Statbuf,error) {
+	v := tx.Bucket(bMeta).Get(id[:])
+	if v==nil { return nil,pathErr(op,id,"",syscall.ENOENT) }
+	sb := new(quickfs.Statbuf)
+	e := gob.NewDecoder(bytes.NewReader(v)).Decode(sb)
+	if e!=nil { return nil,e }
+	if sb.Atime.IsZero() { sb.Atime = sb.ModTime }
+	if sb.Ctime.IsZero() { sb.Ctime = sb.ModTime }
+	return sb,nil
+}
+func putMeta(tx *bolt.Tx,id *uuid.UUID,sb *quickfs.Statbuf) error {
+	var buf bytes.Buffer
+	e := gob.NewEncoder(&buf).Encode(sb)
+	if e!=nil { return e }
+	return tx.Bucket(bMeta).Put(id[:],buf.Bytes())
+}
+func getDir(tx *bolt.Tx,op string,id *uuid.UUID) (*quickfs.Statbuf,error) {
+	sb,e := getMeta(tx,op,id)
+	if e!=nil { return nil,e }
+	if !sb.IsDir { return nil,pathErr(op,id,"",syscall.ENOTDIR) }
+	return sb,nil
+}
+func getFile(tx *bolt.Tx,op string,id *uuid.UUID) (*quickfs.Statbuf,error) {
+	sb,e := getMeta(tx,op,id)
+	if e!=nil { return nil,e }
+	if sb.IsDir { return nil,pathErr(op,id,"",syscall.EISDIR) }
+	return sb,nil
+}
+// Records a modification of the content.
+func touch(tx *bolt.Tx,id *uuid.UUID,sb *quickfs.Statbuf) error {
+	sb.ModTime = time.Now()
+	sb.Ctime = sb.ModTime
+	return putMeta(tx,id,sb)
+}
+// Records a change of the metadata only.
+func change(tx *bolt.Tx,id *uuid.UUID,sb *quickfs.Statbuf) error {
+	sb.Ctime = time.Now()
+	return putMeta(tx,id,sb)
+}
+// A new node. Reads don't update the Atime.
+func newMeta(sb quickfs.Statbuf) *quickfs.Statbuf {
+	t := time.Now()
+	sb.Nlink = 1
+	sb.ModTime,sb.Atime,sb.Ctime,sb.Btime = t,t,t,t
+	return &sb
+}
+
+// Removes a node including its content. Directories must be empty.
+func delNode(tx *bolt.Tx,op string,id *uuid.UUID) error {
+	sb,e := getMeta(tx,op,id)
+	if e!=nil { return e }
+	if sb.IsDir {
+		c := tx.Bucket(bDirents).Cursor()
+		if k,_ := c.Seek(id[:]); k!=nil && bytes.HasPrefix(k,id[:]) {
+			return pathErr(op,id,"",syscall.ENOTEMPTY)
+		}
+	}
+	for _,bn := range [][]byte{bData,bXattrs} {
+		b := tx.Bucket(bn)
+		for _,k := range prefixKeys(b,id[:]) {
+			if e = b.Delete(k); e!=nil { return e }
+		}
+	}
+	return tx.Bucket(bMeta).Delete(id[:])
+}
+
+func (fs *FileSystem) Mkfile(id *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"mkfile",id)
+		if e==nil {
+			if sb.IsDir { return pathErr("mkfile",id,"",syscall.EISDIR) }
+			return nil
+		}
+		return putMeta(tx,id,newMeta(quickfs.Statbuf{IsRegular:true,Mode:0666}))
+	})
+}
+func (fs *FileSystem) Mkdir(id *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		if _,e := getMeta(tx,"mkdir",id); e==nil { return pathErr("mkdir",id,"",syscall.EEXIST) }
+		return putMeta(tx,id,newMeta(quickfs.Statbuf{IsDir:true,Mode:0777}))
+	})
+}
+// The target of a symlink is stored as its content.
+func (fs *FileSystem) Mksymlink(id *uuid.UUID,target string) error {
+	if len(target)>ChunkSize { return pathErr("symlink",id,"",syscall.ENAMETOOLONG) }
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		if _,e := getMeta(tx,"symlink",id); e==nil { return pathErr("symlink",id,"",syscall.EEXIST) }
+		sb := newMeta(quickfs.Statbuf{IsSymlink:true,Mode:0777,Size:int64(len(target))})
+		if e := tx.Bucket(bData).Put(chunkKey(id,0),[]byte(target)); e!=nil { return e }
+		return putMeta(tx,id,sb)
+	})
+}
+func (fs *FileSystem) Readlink(id *uuid.UUID) (target string,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"readlink",id)
+		if e!=nil { return e }
+		if !sb.IsSymlink { return pathErr("readlink",id,"",syscall.EINVAL) }
+		target = string(tx.Bucket(bData).Get(chunkKey(id,0)))
+		return nil
+	})
+	return
+}
+func (fs *FileSystem) Lookup(id *uuid.UUID,name string) (cid *uuid.UUID,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		if _,e := getDir(tx,"lookup",id); e!=nil { return e }
+		v := tx.Bucket(bDirents).Get(direntKey(id,name))
+		if v==nil { return pathErr("lookup",id,name,syscall.ENOENT) }
+		var e error
+		cid,e = uuid.Parse(v)
+		return e
+	})
+	return
+}
+func (fs *FileSystem) PutDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getDir(tx,"putdirent",id)
+		if e!=nil { return e }
+		k := direntKey(id,name)
+		d := tx.Bucket(bDirents)
+		if d.Get(k)!=nil { return pathErr("putdirent",id,name,syscall.EEXIST) }
+		if _,e = getMeta(tx,"putdirent",child); e!=nil { return e }
+		if e = d.Put(k,child[:]); e!=nil { return e }
+		return touch(tx,id,sb)
+	})
+}
+func (fs *FileSystem) LinkDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getDir(tx,"link",id)
+		if e!=nil { return e }
+		csb,e := getMeta(tx,"link",child)
+		if e!=nil { return e }
+		if csb.IsDir { return pathErr("link",child,"",syscall.EPERM) }
+		k := direntKey(id,name)
+		d := tx.Bucket(bDirents)
+		if d.Get(k)!=nil { return pathErr("link",id,name,syscall.EEXIST) }
+		if e = d.Put(k,child[:]); e!=nil { return e }
+		csb.Nlink++
+		if e = change(tx,child,csb); e!=nil { return e }
+		return touch(tx,id,sb)
+	})
+}
+func (fs *FileSystem) DelDirent(id *uuid.UUID,name string) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getDir(tx,"deldirent",id)
+		if e!=nil { return e }
+		k := direntKey(id,name)
+		d := tx.Bucket(bDirents)
+		if d.Get(k)==nil { return pathErr("deldirent",id,name,syscall.ENOENT) }
+		if e = d.Delete(k); e!=nil { return e }
+		return touch(tx,id,sb)
+	})
+}
+func (fs *FileSystem) DelDirentFull(id *uuid.UUID,name string) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getDir(tx,"deldirent",id)
+		if e!=nil { return e }
+		k := direntKey(id,name)
+		d := tx.Bucket(bDirents)
+		v := d.Get(k)
+		if v==nil { return pathErr("deldirent",id,name,syscall.ENOENT) }
+		cid,e := uuid.Parse(v)
+		if e!=nil { return e }
+		if e = d.Delete(k); e!=nil { return e }
+		if e = dropLink(tx,"deldirent",cid); e!=nil { return e }
+		return touch(tx,id,sb)
+	})
+}
+// Decrements the link count of a node, and removes it, once it drops to zero.
+func dropLink(tx *bolt.Tx,op string,id *uuid.UUID) error {
+	sb,e := getMeta(tx,op,id)
+	if e!=nil { return e }
+	if sb.Nlink>1 {
+		sb.Nlink--
+		return change(tx,id,sb)
+	}
+	return delNode(tx,op,id)
+}
+func (fs *FileSystem) SetDirent(id *uuid.UUID,name string, child *uuid.UUID) (old *uuid.UUID,err error) {
+	err = fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getDir(tx,"setdirent",id)
+		if e!=nil { return e }
+		if _,e = getMeta(tx,"setdirent",child); e!=nil { return e }
+		k := direntKey(id,name)
+		d := tx.Bucket(bDirents)
+		if v := d.Get(k); v!=nil {
+			if old,e = uuid.Parse(v); e!=nil { return e }
+		}
+		if e = d.Put(k,child[:]); e!=nil { return e }
+		return touch(tx,id,sb)
+	})
+	return
+}
+func (fs *FileSystem) DropLink(id *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		return dropLink(tx,"droplink",id)
+	})
+}
+func (fs *FileSystem) DelNode(id *uuid.UUID) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		return delNode(tx,"delnode",id)
+	})
+}
+func (fs *FileSystem) Stat(id *uuid.UUID) (fi os.FileInfo, err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"stat",id)
+		if e!=nil { return e }
+		fi = sb.FileInfo(id.String())
+		return nil
+	})
+	return
+}
+// Every update is committed durably, unless the database is opened with
+// NoSync. In that case, the whole database is synced.
+func (fs *FileSystem) Fsync(id *uuid.UUID,dataOnly bool) error {
+	e := fs.DB.View(func(tx *bolt.Tx) error {
+		_,e := getMeta(tx,"fsync",id)
+		return e
+	})
+	if e!=nil || !fs.DB.NoSync { return e }
+	return fs.DB.Sync()
+}
+func (fs *FileSystem) Chtimes(id *uuid.UUID,atime time.Time, mtime time.Time) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"chtimes",id)
+		if e!=nil { return e }
+		sb.Atime = atime
+		sb.ModTime = mtime
+		return change(tx,id,sb)
+	})
+}
+func (fs *FileSystem) Chmod(id *uuid.UUID,mode uint32) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"chmod",id)
+		if e!=nil { return e }
+		sb.Mode = mode&07777
+		return change(tx,id,sb)
+	})
+}
+func (fs *FileSystem) Chown(id *uuid.UUID,uid, gid uint32) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"chown",id)
+		if e!=nil { return e }
+		if uid!=^uint32(0) { sb.Uid = uid }
+		if gid!=^uint32(0) { sb.Gid = gid }
+		return change(tx,id,sb)
+	})
+}
+func (fs *FileSystem) GetXAttr(id *uuid.UUID,name string) (v []byte,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		if _,e := getMeta(tx,"getxattr",id); e!=nil { return e }
+		b := tx.Bucket(bXattrs).Get(direntKey(id,name))
+		if b==nil { return pathErr("getxattr",id,"",quickfs.ErrNoAttr) }
+		v = append([]byte{},b...)
+		return nil
+	})
+	return
+}
+func (fs *FileSystem) SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"setxattr",id)
+		if e!=nil { return e }
+		k := direntKey(id,name)
+		x := tx.Bucket(bXattrs)
+		ok := x.Get(k)!=nil
+		if ok && (flags&quickfs.XAttrCreate)!=0 { return pathErr("setxattr",id,"",syscall.EEXIST) }
+		if !ok && (flags&quickfs.XAttrReplace)!=0 { return pathErr("setxattr",id,"",quickfs.ErrNoAttr) }
+		if e = x.Put(k,append([]byte{},data...)); e!=nil { return e }
+		return change(tx,id,sb)
+	})
+}
+func (fs *FileSystem) ListXAttr(id *uuid.UUID) (names []string,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		if _,e := getMeta(tx,"listxattr",id); e!=nil { return e }
+		names = []string{}
+		for _,k := range prefixKeys(tx.Bucket(bXattrs),id[:]) {
+			names = append(names,string(k[16:]))
+		}
+		return nil
+	})
+	return
+}
+func (fs *FileSystem) RemoveXAttr(id *uuid.UUID,name string) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"removexattr",id)
+		if e!=nil { return e }
+		k := direntKey(id,name)
+		x := tx.Bucket(bXattrs)
+		if x.Get(k)==nil { return pathErr("removexattr",id,"",quickfs.ErrNoAttr) }
+		if e = x.Delete(k); e!=nil { return e }
+		return change(tx,id,sb)
+	})
+}
+func (fs *FileSystem) SetIno(id *uuid.UUID,ino uint64) error {
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getMeta(tx,"setino",id)
+		if e!=nil { return e }
+		sb.Ino = ino
+		return putMeta(tx,id,sb)
+	})
+}
+func (fs *FileSystem) Truncate(id *uuid.UUID,size int64) error {
+	if size<0 { return pathErr("truncate",id,"",syscall.EINVAL) }
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getFile(tx,"truncate",id)
+		if e!=nil { return e }
+		data := tx.Bucket(bData)
+		last := size/ChunkSize
+		for _,k := range prefixKeys(data,id[:]) {
+			i := int64(binary.BigEndian.Uint64(k[16:]))
+			if i<last { continue }
+			if i>last { e = data.Delete(k) }
+			if i==last {
+				c := data.Get(k)
+				if rest := int(size%ChunkSize); rest==0 {
+					e = data.Delete(k)
+				}else if rest<len(c) {
+					e = data.Put(k,append([]byte(nil),c[:rest]...))
+				}
+			}
+			if e!=nil { return e }
+		}
+		sb.Size = size
+		return touch(tx,id,sb)
+	})
+}
+func (fs *FileSystem) ReadAt(id *uuid.UUID, b []byte, off int64) (n int,err error) {
+	if off<0 { return 0,pathErr("read",id,"",syscall.EINVAL) }
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		sb,e := getFile(tx,"read",id)
+		if e!=nil { return e }
+		if off>=sb.Size { return io.EOF }
+		end := off+int64(len(b))
+		if end>sb.Size { end = sb.Size }
+		data := tx.Bucket(bData)
+		for pos := off; pos<end; {
+			i,o := pos/ChunkSize,pos%ChunkSize
+			l := ChunkSize-o
+			if pos+l>end { l = end-pos }
+			dst := b[pos-off:pos-off+l]
+			c := data.Get(chunkKey(id,i))
+			if o<int64(len(c)) {
+				c = c[o:]
+			}else{
+				c = nil
+			}
+			m := copy(dst,c)
+			for j := range dst[m:] { dst[m+j] = 0 }
+			pos += l
+		}
+		n = int(end-off)
+		if n<len(b) { return io.EOF }
+		return nil
+	})
+	return
+}
+func (fs *FileSystem) WriteAt(id *uuid.UUID, b []byte, off int64) (n int,err error) {
+	if off<0 { return 0,pathErr("write",id,"",syscall.EINVAL) }
+	err = fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getFile(tx,"write",id)
+		if e!=nil { return e }
+		n = len(b)
+		return writeChunks(tx,id,sb,b,off)
+	})
+	if err!=nil { n = 0 }
+	return
+}
+func writeChunks(tx *bolt.Tx,id *uuid.UUID,sb *quickfs.Statbuf,b []byte,off int64) error {
+	data := tx.Bucket(bData)
+	end := off+int64(len(b))
+	for pos := off; pos<end; {
+		i,o := pos/ChunkSize,pos%ChunkSize
+		l := ChunkSize-o
+		if pos+l>end { l = end-pos }
+		k := chunkKey(id,i)
+		c := append([]byte(nil),data.Get(k)...)
+		if int64(len(c))<o+l { c = append(c,make([]byte,o+l-int64(len(c)))...) }
+		copy(c[o:],b[pos-off:pos-off+l])
+		if e := data.Put(k,c); e!=nil { return e }
+		pos += l
+	}
+	if end>sb.Size { sb.Size = end }
+	return touch(tx,id,sb)
+}
+// Appends within a single transaction.
+func (fs *FileSystem) Append(id *uuid.UUID, b []byte) (end int64,err error) {
+	err = fs.DB.Update(func(tx *bolt.Tx) error {
+		sb,e := getFile(tx,"append",id)
+		if e!=nil { return e }
+		end = sb.Size+int64(len(b))
+		return writeChunks(tx,id,sb,b,sb.Size)
+	})
+	if err!=nil { end = 0 }
+	return
+}
+// Dirents are kept sorted by name, so the cookie is a seek position.
+func (fs *FileSystem) Readdir(id *uuid.UUID,cookie string,max int) (names []string,next string,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		if _,e := getDir(tx,"readdir",id); e!=nil { return e }
+		c := tx.Bucket(bDirents).Cursor()
+		names = []string{}
+		k,_ := c.Seek(direntKey(id,cookie))
+		if k!=nil && cookie!="" && string(k[16:])==cookie { k,_ = c.Next() }
+		for ; k!=nil && bytes.HasPrefix(k,id[:]); k,_ = c.Next() {
+			if max>0 && len(names)==max {
+				next = names[max-1]
+				break
+			}
+			names = append(names,string(k[16:]))
+		}
+		return nil
+	})
+	return
+}
+func (fs *FileSystem) Readdirnames(id *uuid.UUID) (names []string,err error) {
+	err = fs.DB.View(func(tx *bolt.Tx) error {
+		if _,e := getDir(tx,"readdir",id); e!=nil { return e }
+		c := tx.Bucket(bDirents).Cursor()
+		names = []string{}
+		for k,_ := c.Seek(id[:]); k!=nil && bytes.HasPrefix(k,id[:]); k,_ = c.Next() {
+			names = append(names,string(k[16:]))
+		}
+		return nil
+	})
+	return
+}
+
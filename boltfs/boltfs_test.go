@@ -0,0 +1,103 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package boltfs
+
+import "github.com/byte-mug/quickfs"
+import "github.com/nu7hatch/gouuid"
+import bolt "go.etcd.io/bbolt"
+import "bytes"
+import "errors"
+import "io/ioutil"
+import "os"
+import "syscall"
+import "testing"
+
+func open(t *testing.T) (*FileSystem,*quickfs.HL_Wrap) {
+	dir,e := ioutil.TempDir("","boltfs")
+	if e!=nil { t.Fatal(e) }
+	m,e := Open(dir+"/db")
+	if e!=nil { t.Fatal(e) }
+	t.Cleanup(func() {
+		m.Close()
+		os.RemoveAll(dir)
+	})
+	if e := m.Mkdir(uuid.NamespaceURL); e!=nil { t.Fatal(e) }
+	return m,&quickfs.HL_Wrap{LL_Facade:m}
+}
+
+// Content, that spans chunks, is written, truncated and extended.
+func TestChunks(t *testing.T) {
+	_,h := open(t)
+	f,e := h.HL_Mkfile(uuid.NamespaceURL,"f",0)
+	if e!=nil { t.Fatal(e) }
+	big := bytes.Repeat([]byte("abcdefg"),30000)
+	if _,e := h.WriteAt(f,big,5); e!=nil { t.Fatal(e) }
+	b,_ := h.HL_ReadAt2(f,len(big)+100,0)
+	if len(b)!=len(big)+5 || b[0]!=0 || !bytes.Equal(b[5:],big) { t.Fatal(len(b)) }
+	h.Truncate(f,70000)
+	b,_ = h.HL_ReadAt2(f,200000,0)
+	if len(b)!=70000 || !bytes.Equal(b[5:],big[:69995]) { t.Fatal(len(b)) }
+	h.Truncate(f,300000)
+	b,_ = h.HL_ReadAt2(f,300000,0)
+	if len(b)!=300000 || b[70000]!=0 || b[299999]!=0 { t.Fatal(len(b)) }
+	var sb quickfs.Statbuf
+	h.HL_Stat(f,&sb)
+	if sb.Size!=300000 || !sb.IsRegular { t.Fatal(sb) }
+}
+
+// Removing the last link of a node removes its data and attributes.
+func TestRemove(t *testing.T) {
+	m,h := open(t)
+	root := uuid.NamespaceURL
+	d,_ := h.HL_Mkdir(root,"d",0)
+	f,_ := h.HL_Mkfile(d,"f",0)
+	h.WriteAt(f,[]byte("data"),0)
+	if e := h.SetXAttr(f,"user.a",[]byte("x"),quickfs.XAttrCreate); e!=nil { t.Fatal(e) }
+	if e := h.HL_Link(root,"g",f); e!=nil { t.Fatal(e) }
+	if e := h.HL_Delete(root,"d"); !errors.Is(e,syscall.ENOTEMPTY) { t.Fatal(e) }
+	if e := h.HL_DeleteTree(root,"d"); e!=nil { t.Fatal(e) }
+	var sb quickfs.Statbuf
+	if e := h.HL_Stat(f,&sb); e!=nil || sb.Nlink!=1 { t.Fatal(sb.Nlink,e) }
+	if e := h.HL_Delete(root,"g"); e!=nil { t.Fatal(e) }
+	if _,e := m.Stat(f); !os.IsNotExist(e) { t.Fatal(e) }
+	m.DB.View(func(tx *bolt.Tx) error {
+		for _,b := range [][]byte{bData,bXattrs} {
+			if n := tx.Bucket(b).Stats().KeyN; n!=0 { t.Errorf("%s: %d keys left",b,n) }
+		}
+		return nil
+	})
+}
+
+// Missing attributes are reported with the error of the platform.
+func TestXAttr(t *testing.T) {
+	_,h := open(t)
+	f,_ := h.HL_Mkfile(uuid.NamespaceURL,"f",0)
+	if _,e := h.GetXAttr(f,"user.a"); !errors.Is(e,quickfs.ErrNoAttr) { t.Fatal(e) }
+	if e := h.SetXAttr(f,"user.a",[]byte("x"),quickfs.XAttrReplace); !errors.Is(e,quickfs.ErrNoAttr) { t.Fatal(e) }
+	if e := h.SetXAttr(f,"user.a",[]byte("x"),quickfs.XAttrCreate); e!=nil { t.Fatal(e) }
+	if e := h.SetXAttr(f,"user.a",[]byte("y"),quickfs.XAttrCreate); !errors.Is(e,os.ErrExist) { t.Fatal(e) }
+	if b,e := h.GetXAttr(f,"user.a"); string(b)!="x" || e!=nil { t.Fatal(b,e) }
+}
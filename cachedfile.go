@@ -27,64 +27,195 @@ package quickfs
 
 import "github.com/nu7hatch/gouuid"
 import "github.com/hashicorp/golang-lru"
+import "io"
 import "os"
+import "sort"
+import "sync"
 
 type CachedFileSystem struct {
 	*FileSystem
 	Cache *lru.Cache
+	
+	// Appends to a node are serialized by one of these, chosen by its UUID.
+	appends [64]sync.Mutex
+	
+	// The rest of recent directory listings, keyed by the cookie of their
+	// next page. They are dropped, when the directory changes.
+	listings *lru.Cache
+	listLock sync.Mutex
+	listGen  uint64
+}
+
+// Number of directory listings kept in progress.
+const cachedListings = 64
+
+type listingKey struct {
+	id     uuid.UUID
+	cookie string
+}
+
+// An open file in the Cache. Users pin it for the duration of an operation,
+// so that it is closed only once it has been evicted and is idle.
+type cachedFile struct {
+	*os.File
+	lock    sync.Mutex
+	refs    int
+	evicted bool
+}
+// Fails, if the file has already been closed.
+func (f *cachedFile) pin() bool {
+	f.lock.Lock(); defer f.lock.Unlock()
+	if f.evicted && f.refs==0 { return false }
+	f.refs++
+	return true
+}
+func (f *cachedFile) release() {
+	f.lock.Lock(); defer f.lock.Unlock()
+	f.refs--
+	if f.evicted && f.refs==0 { f.Close() }
 }
 func cacheEvict(key interface{}, value interface{}) {
-	value.(*os.File).Close()
+	f := value.(*cachedFile)
+	f.lock.Lock(); defer f.lock.Unlock()
+	f.evicted = true
+	if f.refs==0 { f.Close() }
 }
 func (fs *CachedFileSystem) Init(f2 *FileSystem,size int) *CachedFileSystem{
 	if f2!=nil { fs.FileSystem = f2 }
 	if size<0 { panic("Size < 0") }
 	fs.Cache,_ = lru.NewWithEvict(size,cacheEvict)
+	fs.listings,_ = lru.New(cachedListings)
+	fs.FileSystem.changed = fs.dropListings
 	return fs
 }
+func (fs *CachedFileSystem) dropListings(id *uuid.UUID) {
+	fs.listLock.Lock(); defer fs.listLock.Unlock()
+	fs.listGen++
+	for _,k := range fs.listings.Keys() {
+		if k.(listingKey).id==*id { fs.listings.Remove(k) }
+	}
+}
 func (fs *CachedFileSystem) Mkfile(id *uuid.UUID) error {
 	f,e := fs.Open(id,os.O_CREATE|os.O_RDWR)
 	if e!=nil { return e }
 	f.Close()
 	return e
 }
-func (fs *CachedFileSystem) getFile(id *uuid.UUID) (*os.File,error) {
+// Returns the cached file pinned, or nil. Call release() when done.
+func (fs *CachedFileSystem) cached(ids string) *cachedFile {
+	for {
+		v,ok := fs.Cache.Get(ids)
+		if !ok { return nil }
+		if f := v.(*cachedFile); f.pin() { return f }
+		// Evicted in the meantime.
+	}
+}
+// Returns the file pinned. Call release() when done.
+func (fs *CachedFileSystem) getFile(id *uuid.UUID) (*cachedFile,error) {
 	fn,ids := fs.extrude2(id)
-	f,ok := fs.Cache.Get(ids)
-	if ok { return f.(*os.File),nil }
-	f,e := os.OpenFile(fn,os.O_RDWR,0600)
-	if e!=nil { return nil,e }
-	fs.Cache.Add(ids,f)
-	return f.(*os.File),nil
+	for {
+		if f := fs.cached(ids); f!=nil { return f,nil }
+		o,e := os.OpenFile(fn,os.O_RDWR,0600)
+		if e!=nil { return nil,e }
+		f := &cachedFile{File:o,refs:1}
+		// Another user might have been faster.
+		if ok,_ := fs.Cache.ContainsOrAdd(ids,f); !ok { return f,nil }
+		o.Close()
+	}
+}
+// Drops the cached file of a node, that may have been removed. It is closed,
+// once it is idle.
+func (fs *CachedFileSystem) forget(id *uuid.UUID) {
+	fs.Cache.Remove(id.String())
+}
+func (fs *CachedFileSystem) DelDirentFull(id *uuid.UUID,name string) error {
+	cld,err := fs.Lookup(id,name)
+	e := fs.FileSystem.DelDirentFull(id,name)
+	if err==nil { fs.forget(cld) }
+	return e
+}
+func (fs *CachedFileSystem) DelNode(id *uuid.UUID) error {
+	e := fs.FileSystem.DelNode(id)
+	fs.forget(id)
+	return e
+}
+func (fs *CachedFileSystem) DropLink(id *uuid.UUID) error {
+	e := fs.FileSystem.DropLink(id)
+	fs.forget(id)
+	return e
+}
+// Syncs all cached files and releases their descriptors. Files in use are
+// closed, once they are idle.
+func (fs *CachedFileSystem) Flush() error {
+	var err error
+	for _,k := range fs.Cache.Keys() {
+		f := fs.cached(k.(string))
+		if f==nil { continue }
+		if e := f.Sync(); e!=nil && err==nil { err = e }
+		f.release()
+	}
+	fs.Cache.Purge()
+	return err
+}
+// Releases all cached descriptors, see Flush. Call this on shutdown.
+func (fs *CachedFileSystem) Close() error {
+	return fs.Flush()
 }
 func (fs *CachedFileSystem) Stat(id *uuid.UUID) (os.FileInfo, error) {
 	fn,ids := fs.extrude2(id)
-	f,ok := fs.Cache.Get(ids)
-	if ok {
-		return f.(*os.File).Stat()
+	var fi os.FileInfo
+	var e error
+	if f := fs.cached(ids); f!=nil {
+		fi,e = f.Stat()
+		f.release()
 	}else{
-		return os.Stat(fn)
+		fi,e = os.Stat(fn)
 	}
+	if e!=nil { return nil,e }
+	return fs.statInfo(fn,fi),nil
 }
 func (fs *CachedFileSystem) Truncate(id *uuid.UUID,size int64) (error) {
 	fn,ids := fs.extrude2(id)
-	f,ok := fs.Cache.Get(ids)
-	if ok {
-		return f.(*os.File).Truncate(size)
-	}else{
-		return os.Truncate(fn,size)
+	if f := fs.cached(ids); f!=nil {
+		defer f.release()
+		return f.Truncate(size)
 	}
+	return os.Truncate(fn,size)
 }
 func (fs *CachedFileSystem) ReadAt(id *uuid.UUID, b []byte, off int64) (int,error) {
 	f,e := fs.getFile(id)
 	if e!=nil { return 0,e }
+	defer f.release()
 	return f.ReadAt(b,off)
 }
 func (fs *CachedFileSystem) WriteAt(id *uuid.UUID, b []byte, off int64) (int,error) {
 	f,e := fs.getFile(id)
 	if e!=nil { return 0,e }
+	defer f.release()
 	return f.WriteAt(b,off)
 }
+// The cached descriptor might be replaced meanwhile, so the lock is keyed by
+// the node, not by the descriptor.
+func (fs *CachedFileSystem) Append(id *uuid.UUID, b []byte) (int64,error) {
+	l := &fs.appends[id[0]%byte(len(fs.appends))]
+	l.Lock(); defer l.Unlock()
+	f,e := fs.getFile(id)
+	if e!=nil { return 0,e }
+	defer f.release()
+	fi,e := f.Stat()
+	if e!=nil { return 0,e }
+	n,e := f.WriteAt(b,fi.Size())
+	return fi.Size()+int64(n),e
+}
+func (fs *CachedFileSystem) Fsync(id *uuid.UUID,dataOnly bool) error {
+	if f := fs.cached(id.String()); f!=nil {
+		e := syncFile(f.File,dataOnly)
+		f.release()
+		if e!=nil { return e }
+		return fs.syncEntry(id)
+	}
+	return fs.FileSystem.Fsync(id,dataOnly)
+}
 func (fs *CachedFileSystem) Readdirnames(id *uuid.UUID) ([]string,error) {
 	fn := fs.extrude(id)
 	f,e := os.Open(fn)
@@ -92,4 +223,43 @@ func (fs *CachedFileSystem) Readdirnames(id *uuid.UUID) ([]string,error) {
 	defer f.Close()
 	return f.Readdirnames(0)
 }
+// The directory is read once per listing. The sorted rest is kept for the
+// next page, so listing it page by page costs no more than reading it. If the
+// directory changes meanwhile, the next page is read from it again.
+func (fs *CachedFileSystem) Readdir(id *uuid.UUID,cookie string,max int) ([]string,string,error) {
+	fs.listLock.Lock()
+	gen := fs.listGen
+	var v interface{}
+	ok := false
+	if cookie!="" && fs.listings!=nil {
+		v,ok = fs.listings.Get(listingKey{*id,cookie})
+		if ok { fs.listings.Remove(listingKey{*id,cookie}) }
+	}
+	fs.listLock.Unlock()
+	if ok { return fs.page(id,v.([]string),max,gen) }
+	f,e := os.Open(fs.extrude(id))
+	if e!=nil { return nil,"",e }
+	defer f.Close()
+	var names []string
+	for {
+		batch,e := f.Readdirnames(1024)
+		for _,name := range batch {
+			if name>cookie { names = append(names,name) }
+		}
+		if e==io.EOF { break }
+		if e!=nil { return nil,"",e }
+	}
+	sort.Strings(names)
+	return fs.page(id,names,max,gen)
+}
+// Returns the first page of the sorted names, and keeps the rest, unless a
+// directory has changed since generation gen.
+func (fs *CachedFileSystem) page(id *uuid.UUID,names []string,max int,gen uint64) ([]string,string,error) {
+	if max<=0 || len(names)<=max { return names,"",nil }
+	next := names[max-1]
+	fs.listLock.Lock()
+	if fs.listings!=nil && fs.listGen==gen { fs.listings.Add(listingKey{*id,next},names[max:]) }
+	fs.listLock.Unlock()
+	return names[:max:max],next,nil
+}
 
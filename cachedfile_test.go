@@ -0,0 +1,172 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "sync"
+import "testing"
+
+// Hammers the cached files with I/O, evictions and deletes at once. Run it
+// with -race. A file closed while still pinned shows up as an I/O error.
+func TestCachedFileStress(t *testing.T) {
+	dir,e := ioutil.TempDir("","quickfs")
+	if e!=nil { t.Fatal(e) }
+	defer os.RemoveAll(dir)
+	fs := new(CachedFileSystem).Init(&FileSystem{Prefix:dir+"/"},2)
+	defer fs.Close()
+	root := uuid.NamespaceURL
+	if e = fs.Mkdir(root); e!=nil { t.Fatal(e) }
+	h := &HL_Wrap{LL_Facade:fs}
+	
+	const workers = 8
+	const rounds = 100
+	var shared []*uuid.UUID
+	for i := 0; i<4; i++ {
+		id,e := h.HL_Mkfile(root,fmt.Sprint("shared",i),CreateExclusive)
+		if e!=nil { t.Fatal(e) }
+		shared = append(shared,id)
+	}
+	var victim struct {
+		sync.Mutex
+		id *uuid.UUID
+	}
+	victim.id = shared[0]
+	
+	errs := make(chan error,workers+2)
+	var workersWg,helpersWg sync.WaitGroup
+	done := make(chan struct{})
+	run := func(wg *sync.WaitGroup,f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := f(); e!=nil { errs <- e }
+		}()
+	}
+	stopped := func() bool {
+		select {
+		case <-done: return true
+		default: return false
+		}
+	}
+	
+	// Each worker owns a region of every shared file, and a file of its own.
+	for w := 0; w<workers; w++ {
+		w := w
+		run(&workersWg,func() error {
+			pat := bytes.Repeat([]byte{byte('a'+w)},16)
+			b := make([]byte,16)
+			for i := 0; i<rounds; i++ {
+				id := shared[i%len(shared)]
+				if _,e := fs.WriteAt(id,pat,int64(w*16)); e!=nil { return e }
+				if _,e := fs.ReadAt(id,b,int64(w*16)); e!=nil { return e }
+				if !bytes.Equal(b,pat) { return fmt.Errorf("worker %d read %q",w,b) }
+				if _,e := fs.Stat(id); e!=nil { return e }
+				
+				name := fmt.Sprint("own",w)
+				own,e := h.HL_Mkfile(root,name,CreateExclusive)
+				if e!=nil { return e }
+				if _,e = fs.Append(own,pat); e!=nil { return e }
+				if e = fs.Fsync(own,true); e!=nil { return e }
+				if e = fs.Truncate(own,8); e!=nil { return e }
+				if e = h.HL_Delete(root,name); e!=nil { return e }
+				
+				// The victim is deleted under the readers, which may only see
+				// it vanish.
+				victim.Lock()
+				v := victim.id
+				victim.Unlock()
+				if _,e = fs.ReadAt(v,b,0); e!=nil && e!=io.EOF && CodeOf(e)!=CodeNoEnt { return e }
+			}
+			return nil
+		})
+	}
+	run(&helpersWg,func() error {
+		for !stopped() { fs.Cache.Purge() }
+		return nil
+	})
+	run(&helpersWg,func() error {
+		for !stopped() {
+			id,e := h.HL_Mkfile(root,"victim",CreateExclusive)
+			if e!=nil { return e }
+			victim.Lock()
+			victim.id = id
+			victim.Unlock()
+			if _,e = fs.WriteAt(id,[]byte("x"),0); e!=nil { return e }
+			if e = h.HL_Delete(root,"victim"); e!=nil { return e }
+		}
+		return nil
+	})
+	workersWg.Wait()
+	close(done)
+	helpersWg.Wait()
+	close(errs)
+	for e := range errs { t.Error(e) }
+	
+	for _,id := range shared {
+		b := make([]byte,workers*16)
+		if _,e := fs.ReadAt(id,b,0); e!=nil { t.Fatal(e) }
+		for w := 0; w<workers; w++ {
+			if !bytes.Equal(b[w*16:w*16+16],bytes.Repeat([]byte{byte('a'+w)},16)) { t.Fatalf("region %d: %q",w,b[w*16:w*16+16]) }
+		}
+	}
+}
+
+// Names inserted after the cookie show up on later pages, removed ones don't.
+func TestReaddirLive(t *testing.T) {
+	dir,e := ioutil.TempDir("","quickfs")
+	if e!=nil { t.Fatal(e) }
+	defer os.RemoveAll(dir)
+	cfs := new(CachedFileSystem).Init(&FileSystem{Prefix:dir+"/"},2)
+	defer cfs.Close()
+	root := uuid.NamespaceURL
+	for _,ll := range []LL_Facade{cfs,new(MemFileSystem).Init()} {
+		if e = ll.Mkdir(root); e!=nil { t.Fatal(e) }
+		h := &HL_Wrap{LL_Facade:ll}
+		for i := 0; i<20; i++ {
+			if _,e = h.HL_Mkfile(root,fmt.Sprintf("n%02d",i),CreateExclusive); e!=nil { t.Fatal(e) }
+		}
+		names,cookie,e := h.Readdir(root,"",5)
+		if e!=nil || len(names)!=5 || cookie!="n04" { t.Fatal(names,cookie,e) }
+		for _,name := range []string{"n0a","n99"} {
+			if _,e = h.HL_Mkfile(root,name,CreateExclusive); e!=nil { t.Fatal(e) }
+		}
+		if e = h.HL_Delete(root,"n10"); e!=nil { t.Fatal(e) }
+		seen := make(map[string]bool)
+		for cookie!="" {
+			names,cookie,e = h.Readdir(root,cookie,5)
+			if e!=nil { t.Fatal(e) }
+			for _,name := range names { seen[name] = true }
+		}
+		if !seen["n0a"] || !seen["n99"] || seen["n10"] || len(seen)!=16 {
+			t.Errorf("%T: %v",ll,seen)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "errors"
+import "io/fs"
+import "syscall"
+
+// A portable error code. The values are the errno numbers of Linux, on every
+// platform, so that they can be passed between hosts.
+type Code int
+
+const (
+	CodeOK          Code = 0
+	CodePerm        Code = 1
+	CodeNoEnt       Code = 2
+	CodeIO          Code = 5
+	CodeBadF        Code = 9
+	CodeAccess      Code = 13
+	CodeExist       Code = 17
+	CodeXDev        Code = 18
+	CodeNotDir      Code = 20
+	CodeIsDir       Code = 21
+	CodeInval       Code = 22
+	CodeFBig        Code = 27
+	CodeNoSpc       Code = 28
+	CodeROFS        Code = 30
+	CodeRange       Code = 34
+	CodeNameTooLong Code = 36
+	CodeNoSys       Code = 38
+	CodeNotEmpty    Code = 39
+	CodeLoop        Code = 40
+	CodeNoData      Code = 61
+	CodeNotSup      Code = 95
+)
+
+var codeErrno = map[Code]syscall.Errno{
+	CodePerm:        syscall.EPERM,
+	CodeNoEnt:       syscall.ENOENT,
+	CodeIO:          syscall.EIO,
+	CodeBadF:        syscall.EBADF,
+	CodeAccess:      syscall.EACCES,
+	CodeExist:       syscall.EEXIST,
+	CodeXDev:        syscall.EXDEV,
+	CodeNotDir:      syscall.ENOTDIR,
+	CodeIsDir:       syscall.EISDIR,
+	CodeInval:       syscall.EINVAL,
+	CodeFBig:        syscall.EFBIG,
+	CodeNoSpc:       syscall.ENOSPC,
+	CodeROFS:        syscall.EROFS,
+	CodeRange:       syscall.ERANGE,
+	CodeNameTooLong: syscall.ENAMETOOLONG,
+	CodeNoSys:       syscall.ENOSYS,
+	CodeNotEmpty:    syscall.ENOTEMPTY,
+	CodeLoop:        syscall.ELOOP,
+	CodeNoData:      ErrNoAttr,
+	CodeNotSup:      syscall.ENOTSUP,
+}
+var errnoCode = make(map[syscall.Errno]Code)
+
+func init() {
+	for c,en := range codeErrno { errnoCode[en] = c }
+}
+
+// The errno of the local platform, or 0 if there is none.
+func (c Code) Errno() syscall.Errno {
+	return codeErrno[c]
+}
+
+// An error with a portable code, as it is reconstructed on the far side of
+// a connection. Msg is the text of the original error.
+type Error struct {
+	Code Code
+	Msg  string
+}
+func (e *Error) Error() string { return e.Msg }
+
+// Matches other Errors with the same code, the local syscall.Errno and the
+// fs.Err* values, the errno stands for.
+func (e *Error) Is(target error) bool {
+	if t,ok := target.(*Error); ok { return t.Code==e.Code }
+	en := e.Code.Errno()
+	return en!=0 && errors.Is(en,target)
+}
+
+// Determines the code of an error. Errors, that can't be classified, are
+// CodeIO.
+func CodeOf(err error) Code {
+	if err==nil { return CodeOK }
+	var qe *Error
+	if errors.As(err,&qe) { return qe.Code }
+	var en syscall.Errno
+	if errors.As(err,&en) {
+		if c,ok := errnoCode[en]; ok { return c }
+	}
+	switch {
+	case errors.Is(err,fs.ErrNotExist): return CodeNoEnt
+	case errors.Is(err,fs.ErrExist): return CodeExist
+	case errors.Is(err,fs.ErrPermission): return CodeAccess
+	case errors.Is(err,fs.ErrInvalid): return CodeInval
+	}
+	return CodeIO
+}
@@ -78,7 +78,8 @@ func main(){
 	root = fusebind.NewOpNode(facade,uuid.NamespaceURL)
 	
 	conn := nodefs.NewFileSystemConnector(root, nil)
-	server, err := fuse.NewServer(conn.RawFS(), mountPoint, &fuse.MountOptions{
+	server, err := fuse.NewServer(fusebind.RawFS(conn), mountPoint, &fuse.MountOptions{
+		Options: []string{"default_permissions"},
 		Debug: *debug,
 	})
 	if err != nil {
@@ -0,0 +1,87 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "quickfs"
+import "github.com/nu7hatch/gouuid"
+import "fmt"
+
+import "encoding/json"
+import "flag"
+import "os"
+
+func withSuffix(path string) string {
+	if len(path)==0 { return "" }
+	if path[len(path)-1]!='/' { return path+"/" }
+	return path
+}
+
+// Exit codes, as used by e2fsck.
+const (
+	exitClean     = 0
+	exitRepaired  = 1
+	exitLeft      = 4
+	exitFail      = 8
+	exitUsage     = 16
+)
+
+func main(){
+	
+	// Scans the arg list and sets up flags
+	repair := flag.Bool("repair", false, "apply the proposed repairs.")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("usage: qfs-fsck [-repair] BACKING_STORE")
+		os.Exit(exitUsage)
+	}
+
+	backingStore := withSuffix(flag.Arg(0))
+	
+	fs := &quickfs.FileSystem{Prefix:backingStore}
+	if e := fs.LoadLayout(); e!=nil {
+		fmt.Fprintf(os.Stderr,"Layout fail: %v\n", e)
+		os.Exit(exitFail)
+	}
+	fsck := &quickfs.Fsck{FS:fs,Root:uuid.NamespaceURL}
+	if e := fsck.Check(); e!=nil {
+		fmt.Fprintf(os.Stderr,"Check fail: %v\n", e)
+		os.Exit(exitFail)
+	}
+	
+	// One JSON object per line.
+	enc := json.NewEncoder(os.Stdout)
+	for _,fi := range fsck.Findings { enc.Encode(fi) }
+	
+	if len(fsck.Findings)==0 { os.Exit(exitClean) }
+	if !*repair { os.Exit(exitLeft) }
+	
+	failed := fsck.Repair()
+	for _,fi := range failed {
+		fmt.Fprintf(os.Stderr,"Repair fail: %s %s/%s %s\n",fi.Kind,fi.Dir,fi.Name,fi.Node)
+	}
+	if len(failed)>0 { os.Exit(exitLeft) }
+	os.Exit(exitRepaired)
+}
+
@@ -0,0 +1,86 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "quickfs"
+import "github.com/nu7hatch/gouuid"
+import "fmt"
+
+import "flag"
+import "os"
+
+func withSuffix(path string) string {
+	if len(path)==0 { return "" }
+	if path[len(path)-1]!='/' { return path+"/" }
+	return path
+}
+
+func main(){
+	
+	// Scans the arg list and sets up flags
+	dry := flag.Bool("n", false, "dry run, only report the orphans.")
+	quarantine := flag.Bool("quarantine", false, "move orphans into BACKING_STORE/.quarantine instead of deleting them.")
+	rate := flag.Int("rate", 0, "maximum number of operations per second, 0 for unlimited.")
+	minAge := flag.Duration("min-age", quickfs.DefaultGCMinAge, "leave orphans alone, that have been modified recently, negative to disable.")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("usage: qfs-gc [flags] BACKING_STORE")
+		fmt.Println("The backing store must not be in use meanwhile. To collect a live store,")
+		fmt.Println("run quickfs.GC on the *FileSystem of the server instead.")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	backingStore := withSuffix(flag.Arg(0))
+	
+	fs := &quickfs.FileSystem{Prefix:backingStore}
+	if e := fs.LoadLayout(); e!=nil {
+		fmt.Printf("Layout fail: %v\n", e)
+		os.Exit(1)
+	}
+	cfs := new(quickfs.CachedFileSystem).Init(fs,128)
+	
+	gc := &quickfs.GC{
+		FS: cfs,
+		Root: uuid.NamespaceURL,
+		DryRun: *dry,
+		Quarantine: *quarantine,
+		Rate: *rate,
+		MinAge: *minAge,
+	}
+	r,e := gc.Run()
+	for _,id := range r.Orphans {
+		fmt.Println("orphan",id)
+	}
+	for _,err := range r.Errors {
+		fmt.Println("error",err)
+	}
+	fmt.Printf("reachable %d orphans %d swept %d\n",r.Reachable,len(r.Orphans),r.Swept)
+	if e!=nil {
+		fmt.Printf("GC fail: %v\n", e)
+		os.Exit(1)
+	}
+}
+
@@ -0,0 +1,71 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "quickfs"
+import "fmt"
+
+import "flag"
+import "os"
+
+func withSuffix(path string) string {
+	if len(path)==0 { return "" }
+	if path[len(path)-1]!='/' { return path+"/" }
+	return path
+}
+
+func main(){
+	
+	// Scans the arg list and sets up flags
+	levels := flag.Int("levels", -1, "convert the store to this many fan-out levels.")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("usage: qfs-migrate [-levels N] BACKING_STORE")
+		fmt.Println("The store must not be served while this is running.")
+		os.Exit(2)
+	}
+
+	backingStore := withSuffix(flag.Arg(0))
+	
+	fs := &quickfs.FileSystem{Prefix:backingStore}
+	if e := fs.LoadLayout(); e!=nil {
+		fmt.Printf("Layout fail: %v\n", e)
+		os.Exit(1)
+	}
+	if *levels>=0 {
+		if e := fs.Convert(*levels); e!=nil {
+			fmt.Printf("Convert fail: %v\n", e)
+			os.Exit(1)
+		}
+		fmt.Printf("converted to %d levels\n",*levels)
+	}
+	n,e := fs.MigrateDirents()
+	fmt.Printf("rewrote %d dirents\n",n)
+	if e!=nil {
+		fmt.Printf("Migrate fail: %v\n", e)
+		os.Exit(1)
+	}
+}
+
@@ -26,6 +26,7 @@ package main
 
 import "quickfs/rpcbind"
 import "quickfs"
+import "quickfs/boltfs"
 import "github.com/nu7hatch/gouuid"
 import "fmt"
 
@@ -33,6 +34,9 @@ import "flag"
 import "os"
 import "net"
 import "net/rpc"
+import "os/signal"
+import "sync"
+import "syscall"
 
 func withSuffix(path string) string {
 	if len(path)==0 { return "" }
@@ -44,10 +48,13 @@ func main(){
 	
 	// Scans the arg list and sets up flags
 	//debug := flag.Bool("debug", false, "print debugging messages.")
+	mem := flag.Bool("mem", false, "serve a scratch volume from memory instead of BACKING_STORE.")
+	boltdb := flag.Bool("bolt", false, "BACKING_STORE is a bbolt database file.")
 	flag.Parse()
-	if flag.NArg() < 2 {
+	if flag.NArg() < 2 && !(*mem && flag.NArg()==1) {
 		// TODO - where to get program name?
 		fmt.Println("usage: main LISTEN-ADDR BACKING_STORE")
+		fmt.Println("       main -mem LISTEN-ADDR")
 		os.Exit(2)
 	}
 
@@ -56,12 +63,42 @@ func main(){
 	
 	
 	// Make the QuickFS
-	fs := &quickfs.FileSystem{backingStore}
-	cfs := new(quickfs.CachedFileSystem).Init(fs,128)
+	var ll quickfs.LL_Facade
+	var journal quickfs.Journal
+	var closer interface{ Close() error }
+	if *mem {
+		ll = new(quickfs.MemFileSystem).Init()
+	}else if *boltdb {
+		bfs,e := boltfs.Open(flag.Arg(1))
+		if e!=nil {
+			fmt.Printf("Open fail: %v\n", e)
+			os.Exit(1)
+		}
+		ll = bfs
+		closer = bfs
+	}else{
+		fs := &quickfs.FileSystem{Prefix:backingStore}
+		if e := fs.LoadLayout(); e!=nil {
+			fmt.Printf("Layout fail: %v\n", e)
+			os.Exit(1)
+		}
+		cfs := new(quickfs.CachedFileSystem).Init(fs,128)
+		ll = cfs
+		closer = cfs
+		journal = fs.Journal()
+	}
 	
-	cfs.Mkdir(uuid.NamespaceURL)
+	if e := ll.Mkdir(uuid.NamespaceURL); e!=nil && !os.IsExist(e) {
+		fmt.Printf("Mkdir fail: %v\n", e)
+		os.Exit(1)
+	}
+	hl := &quickfs.HL_Wrap{LL_Facade:ll,Journal:journal}
+	if e := hl.Recover(); e!=nil {
+		fmt.Printf("Recover fail: %v\n", e)
+		os.Exit(1)
+	}
 	var facade quickfs.Facade2
-	facade = &quickfs.HL_Wrap{cfs}
+	facade = hl
 	
 	
 	// Make the RPC server
@@ -74,7 +111,47 @@ func main(){
 		fmt.Printf("Listen fail: %v\n", e)
 		os.Exit(1)
 	}
-	srv.Accept(l)
+	
+	// Stop accepting on a signal, and release the backing store.
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,os.Interrupt,syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+	var lock sync.Mutex
+	var active sync.WaitGroup
+	conns := make(map[net.Conn]bool)
+	for {
+		c,e := l.Accept()
+		if e!=nil { break }
+		lock.Lock()
+		conns[c] = true
+		lock.Unlock()
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			srv.ServeConn(c)
+			lock.Lock()
+			delete(conns,c)
+			lock.Unlock()
+		}()
+	}
+	
+	// Take no new requests, but let those in progress finish, before the
+	// backing store is closed.
+	lock.Lock()
+	for c := range conns {
+		if tc,ok := c.(*net.TCPConn); ok { tc.CloseRead() } else { c.Close() }
+	}
+	lock.Unlock()
+	active.Wait()
+	if closer!=nil {
+		if e := closer.Close(); e!=nil {
+			fmt.Printf("Close fail: %v\n", e)
+			os.Exit(1)
+		}
+	}
 }
 
 
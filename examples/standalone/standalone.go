@@ -34,6 +34,8 @@ import "github.com/hanwen/go-fuse/fuse"
 import "github.com/hanwen/go-fuse/fuse/nodefs"
 import "flag"
 import "os"
+import "os/signal"
+import "syscall"
 
 func withSuffix(path string) string {
 	if len(path)==0 { return "" }
@@ -57,12 +59,24 @@ func main(){
 	
 	
 	// Make the QuickFS
-	fs := &quickfs.FileSystem{backingStore}
+	fs := &quickfs.FileSystem{Prefix:backingStore}
+	if e := fs.LoadLayout(); e!=nil {
+		fmt.Printf("Layout fail: %v\n", e)
+		os.Exit(1)
+	}
 	cfs := new(quickfs.CachedFileSystem).Init(fs,128)
 	
-	cfs.Mkdir(uuid.NamespaceURL)
+	if e := cfs.Mkdir(uuid.NamespaceURL); e!=nil && !os.IsExist(e) {
+		fmt.Printf("Mkdir fail: %v\n", e)
+		os.Exit(1)
+	}
+	hl := &quickfs.HL_Wrap{LL_Facade:cfs,Journal:fs.Journal()}
+	if e := hl.Recover(); e!=nil {
+		fmt.Printf("Recover fail: %v\n", e)
+		os.Exit(1)
+	}
 	var facade quickfs.Facade2
-	facade = &quickfs.HL_Wrap{cfs}
+	facade = hl
 	
 	// Make the Fuse
 	
@@ -71,7 +85,8 @@ func main(){
 	root = fusebind.NewOpNode(facade,uuid.NamespaceURL)
 	
 	conn := nodefs.NewFileSystemConnector(root, nil)
-	server, err := fuse.NewServer(conn.RawFS(), mountPoint, &fuse.MountOptions{
+	server, err := fuse.NewServer(fusebind.RawFS(conn), mountPoint, &fuse.MountOptions{
+		Options: []string{"default_permissions"},
 		Debug: *debug,
 	})
 	if err != nil {
@@ -80,7 +95,19 @@ func main(){
 	}
 	fusebind.Debug = *debug
 	fmt.Println("Mounted!")
+	
+	// Unmount on a signal, and release the cached files.
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,os.Interrupt,syscall.SIGTERM)
+	go func() {
+		<-sig
+		server.Unmount()
+	}()
 	server.Serve()
+	if e := cfs.Close(); e!=nil {
+		fmt.Printf("Close fail: %v\n", e)
+		os.Exit(1)
+	}
 }
 
 
@@ -0,0 +1,328 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// Reports names, that are not allowed as dirent names.
+func IllegalName(name string) bool {
+	switch name{
+	case "",".","..": return true
+	}
+	for _,b := range []byte(name) {
+		switch b {
+		case '/','\\': return true
+		}
+	}
+	return false
+}
+
+// Kinds of fsck findings.
+const (
+	// The dirent points to a node, that does not exist.
+	FsckDangling = "dangling"
+	// The dirent points outside of the backing store.
+	FsckOutside = "outside"
+	// The dirent has an absolute target, as written by older versions.
+	FsckAbsolute = "absolute"
+	// The entry in the backing store is not named by a valid UUID. Node is
+	// its path, relative to the backing store.
+	FsckBadNode = "bad-node"
+	// The entry within a directory node is not a dirent symlink.
+	FsckNotDirent = "not-dirent"
+	// The dirent has a name, that IllegalName() rejects.
+	FsckIllegalName = "illegal-name"
+	// The directory is referenced by more than one dirent.
+	FsckMultiParent = "multi-parent"
+	// The dirent points to one of its own parent directories.
+	FsckCycle = "cycle"
+	// The node is not reachable from the root.
+	FsckUnreachable = "unreachable"
+	// The link count of the node does not match the number of its dirents.
+	FsckNlink = "nlink"
+)
+
+// Proposed repairs.
+const (
+	// Remove the dirent Dir/Name.
+	RepairDrop = "drop"
+	// Replace the target of the dirent Dir/Name with the plain UUID of Node.
+	RepairRewrite = "rewrite"
+	// Rename the dirent Dir/Name to NewName.
+	RepairRename = "rename"
+	// Move the entry Node into the ".quarantine" directory.
+	RepairQuarantine = "quarantine"
+	// Link the node Node into the "lost+found" directory below the root.
+	RepairRelink = "relink"
+	// Set the link count of Node to Nlink.
+	RepairNlink = "set-nlink"
+)
+
+type FsckFinding struct {
+	Kind    string `json:"kind"`
+	Dir     string `json:"dir,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Node    string `json:"node,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Repair  string `json:"repair"`
+	NewName string `json:"new_name,omitempty"`
+	Nlink   uint64 `json:"nlink,omitempty"`
+}
+
+// An offline consistency checker for a backing store. The store must not be
+// in use, while Check() or Repair() run.
+type Fsck struct {
+	FS   *FileSystem
+	Root *uuid.UUID
+	Findings []*FsckFinding
+	
+	nodes map[uuid.UUID]bool
+	state map[uuid.UUID]int
+}
+
+const (
+	fsckVisiting = iota+1
+	fsckDone
+)
+
+func (f *Fsck) add(fi *FsckFinding) {
+	f.Findings = append(f.Findings,fi)
+}
+
+// Adds a finding, that drops a dirent. Earlier findings on the same dirent
+// (such as a rename) are superseded.
+func (f *Fsck) addDrop(fi *FsckFinding) {
+	n := f.Findings[:0]
+	for _,o := range f.Findings {
+		if o.Dir==fi.Dir && o.Name==fi.Name { continue }
+		n = append(n,o)
+	}
+	f.Findings = append(n,fi)
+}
+func sanitizeName(name string) string {
+	switch name{
+	case "": return "_"
+	case ".","..": return strings.Replace(name,".","_",-1)
+	}
+	return strings.NewReplacer("/","_","\\","_").Replace(name)
+}
+
+// Reads the dirents of a directory node, reporting broken ones.
+// If report is false, broken dirents are silently skipped.
+func (f *Fsck) dirents(id *uuid.UUID,report bool) (map[string]*uuid.UUID,error) {
+	dn := f.FS.extrude(id)
+	d,e := os.Open(dn)
+	if e!=nil { return nil,e }
+	names,e := d.Readdirnames(0)
+	d.Close()
+	if e!=nil { return nil,e }
+	m := make(map[string]*uuid.UUID)
+	for _,name := range names {
+		fi := &FsckFinding{Dir:id.String(),Name:name,Repair:RepairDrop}
+		tgt,e := os.Readlink(dn+"/"+name)
+		if e!=nil {
+			fi.Kind = FsckNotDirent
+			if report { f.add(fi) }
+			continue
+		}
+		fi.Target = tgt
+		cid,e := f.FS.deextrude(tgt)
+		if e!=nil || !f.nodes[*cid] {
+			fi.Kind = FsckDangling
+			if filepath.IsAbs(tgt) && !strings.HasPrefix(tgt,f.FS.Prefix) { fi.Kind = FsckOutside }
+			if report { f.add(fi) }
+			continue
+		}
+		fi.Node = cid.String()
+		if tgt!=fi.Node && report {
+			f.add(&FsckFinding{Kind:FsckAbsolute,Dir:fi.Dir,Name:name,Node:fi.Node,Target:tgt,Repair:RepairRewrite})
+		}
+		if IllegalName(name) {
+			fi.Kind = FsckIllegalName
+			fi.Repair = RepairRename
+			fi.NewName = sanitizeName(name)
+			if report { f.add(fi) }
+		}
+		m[name] = cid
+	}
+	return m,nil
+}
+
+func (f *Fsck) walk(id *uuid.UUID) error {
+	f.state[*id] = fsckVisiting
+	ents,e := f.dirents(id,true)
+	if e!=nil { return e }
+	names := make([]string,0,len(ents))
+	for name := range ents { names = append(names,name) }
+	sort.Strings(names)
+	for _,name := range names {
+		cid := ents[name]
+		fi := &FsckFinding{Dir:id.String(),Name:name,Node:cid.String(),Repair:RepairDrop}
+		st,e := os.Lstat(f.FS.extrude(cid))
+		if e!=nil { return e }
+		if !st.IsDir() {
+			f.state[*cid] = fsckDone
+			continue
+		}
+		switch f.state[*cid] {
+		case fsckVisiting:
+			fi.Kind = FsckCycle
+			f.addDrop(fi)
+		case fsckDone:
+			fi.Kind = FsckMultiParent
+			f.addDrop(fi)
+		default:
+			if e = f.walk(cid); e!=nil { return e }
+		}
+	}
+	f.state[*id] = fsckDone
+	return nil
+}
+
+// Scans the backing store and fills f.Findings.
+func (f *Fsck) Check() error {
+	f.Findings = nil
+	f.nodes = make(map[uuid.UUID]bool)
+	f.state = make(map[uuid.UUID]int)
+	
+	e := f.FS.walkNodes("",0,func(id *uuid.UUID,path string) error {
+		f.nodes[*id] = true
+		return nil
+	},func(path string) {
+		f.add(&FsckFinding{Kind:FsckBadNode,Node:path,Repair:RepairQuarantine})
+	})
+	if e!=nil { return e }
+	
+	if e = f.walk(f.Root); e!=nil { return e }
+	
+	// Only relink the top-most unreachable nodes, their children come along.
+	var lost []*uuid.UUID
+	child := make(map[uuid.UUID]bool)
+	for id := range f.nodes {
+		if f.state[id]!=0 { continue }
+		nid := id
+		lost = append(lost,&nid)
+		if st,e := os.Lstat(f.FS.extrude(&nid)); e!=nil || !st.IsDir() { continue }
+		ents,_ := f.dirents(&nid,false)
+		for _,cid := range ents { child[*cid] = true }
+	}
+	sort.Slice(lost,func(i,j int) bool { return lost[i].String()<lost[j].String() })
+	for _,id := range lost {
+		if child[*id] { continue }
+		f.add(&FsckFinding{Kind:FsckUnreachable,Node:id.String(),Repair:RepairRelink,NewName:id.String()})
+	}
+	f.checkNlink()
+	return nil
+}
+
+// Compares the link count of every node, that is not a directory, with the
+// number of dirents pointing to it. Nodes without any are counted as one, as
+// the relink repair adds one.
+func (f *Fsck) checkNlink() {
+	refs := make(map[uuid.UUID]uint64)
+	var ids []*uuid.UUID
+	for id := range f.nodes {
+		nid := id
+		st,e := os.Lstat(f.FS.extrude(&nid))
+		if e!=nil { continue }
+		if !st.IsDir() {
+			ids = append(ids,&nid)
+			continue
+		}
+		ents,_ := f.dirents(&nid,false)
+		for _,cid := range ents { refs[*cid]++ }
+	}
+	sort.Slice(ids,func(i,j int) bool { return ids[i].String()<ids[j].String() })
+	for _,id := range ids {
+		n := refs[*id]
+		if n==0 { n = 1 }
+		if getMetaUint(f.FS.extrude(id),"nlink",1)==n { continue }
+		f.add(&FsckFinding{Kind:FsckNlink,Node:id.String(),Repair:RepairNlink,Nlink:n})
+	}
+}
+
+func (f *Fsck) dirPath(dir string) string {
+	id,e := uuid.ParseHex(dir)
+	if e!=nil { return f.FS.Prefix+dir+"/" }
+	return f.FS.extrude(id)+"/"
+}
+
+func (f *Fsck) lostFound() (*uuid.UUID,error) {
+	id,e := f.FS.Lookup(f.Root,"lost+found")
+	if e==nil { return id,nil }
+	id,e = uuid.NewV4()
+	if e!=nil { return nil,e }
+	if e = f.FS.Mkdir(id); e!=nil { return nil,e }
+	if e = f.FS.PutDirent(f.Root,"lost+found",id); e!=nil { return nil,e }
+	return id,nil
+}
+
+// Applies the proposed repair of every finding. Findings, that could not be
+// repaired, are returned.
+func (f *Fsck) Repair() (failed []*FsckFinding) {
+	for _,fi := range f.Findings {
+		var e error
+		switch fi.Repair {
+		case RepairDrop:
+			e = os.Remove(f.dirPath(fi.Dir)+fi.Name)
+		case RepairRewrite:
+			f.FS.links.Lock()
+			e = f.FS.replaceLink(f.dirPath(fi.Dir)+fi.Name,fi.Node)
+			f.FS.links.Unlock()
+		case RepairRename:
+			dn := f.dirPath(fi.Dir)
+			nn := fi.NewName
+			if _,e2 := os.Lstat(dn+nn); e2==nil { nn += "."+uuidSuffix() }
+			e = os.Rename(dn+fi.Name,dn+nn)
+		case RepairQuarantine:
+			q := f.FS.Prefix+".quarantine"
+			e = os.MkdirAll(q,0700)
+			if e==nil { e = os.Rename(f.FS.Prefix+fi.Node,q+"/"+strings.Replace(fi.Node,"/","_",-1)) }
+		case RepairRelink:
+			var lf,id *uuid.UUID
+			lf,e = f.lostFound()
+			if e==nil { id,e = uuid.ParseHex(fi.Node) }
+			if e==nil { e = f.FS.PutDirent(lf,fi.NewName,id) }
+		case RepairNlink:
+			var id *uuid.UUID
+			id,e = uuid.ParseHex(fi.Node)
+			if e==nil { e = setMetaUint(f.FS.extrude(id),"nlink",fi.Nlink) }
+		}
+		if e!=nil { failed = append(failed,fi) }
+	}
+	return
+}
+
+func uuidSuffix() string {
+	id,e := uuid.NewV4()
+	if e!=nil { return "x" }
+	return id.String()[:8]
+}
+
@@ -0,0 +1,73 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "io/ioutil"
+import "os"
+import "testing"
+
+// Every kind of damage is found, and repaired.
+func TestFsck(t *testing.T) {
+	dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	fs := &FileSystem{Prefix:dir}
+	root := uuid.NamespaceURL
+	h := &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	if e := h.Mkdir(root); e!=nil { t.Fatal(e) }
+	a,_ := h.HL_Mkdir(root,"a",0)
+	b,_ := h.HL_Mkdir(root,"b",0)
+	f,_ := h.HL_Mkfile(a,"f",0)
+	ad := dir+a.String()+"/"
+	
+	h.PutDirent(a,"loop",root)
+	h.PutDirent(a,"bb",b)
+	h.PutDirent(a,"x\\y",f)
+	os.Symlink("/etc/passwd",ad+"out")
+	os.Symlink(dir+"00000000-0000-0000-0000-000000000000",ad+"dang")
+	os.Symlink(dir+f.String(),ad+"abs")
+	ioutil.WriteFile(ad+"plain",nil,0600)
+	ioutil.WriteFile(dir+"junk",nil,0600)
+	o,_ := h.HL_Mkdir(root,"o",0)
+	h.HL_Mkfile(o,"of",0)
+	h.DelDirent(root,"o")
+	
+	fk := &Fsck{FS:fs,Root:root}
+	if e := fk.Check(); e!=nil { t.Fatal(e) }
+	kinds := make(map[string]int)
+	for _,fi := range fk.Findings { kinds[fi.Kind]++ }
+	for _,k := range []string{FsckCycle,FsckMultiParent,FsckIllegalName,FsckOutside,FsckDangling,FsckAbsolute,FsckNotDirent,FsckBadNode,FsckUnreachable,FsckNlink} {
+		if kinds[k]==0 { t.Error("not found:",k) }
+	}
+	if failed := fk.Repair(); len(failed)!=0 { t.Fatal(failed[0]) }
+	if e := fk.Check(); e!=nil { t.Fatal(e) }
+	for _,fi := range fk.Findings { t.Error("left:",*fi) }
+	
+	lf,e := h.Lookup(root,"lost+found")
+	if e!=nil { t.Fatal(e) }
+	if id,e := h.Lookup(lf,o.String()); e!=nil || *id!=*o { t.Error("not relinked",e) }
+	if id,e := h.Lookup(a,"x_y"); e!=nil || *id!=*f { t.Error("not renamed",e) }
+}
@@ -0,0 +1,129 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package fusebind
+
+import "github.com/hanwen/go-fuse/fuse"
+import "github.com/hanwen/go-fuse/fuse/nodefs"
+import "os"
+import "sync"
+import "syscall"
+
+// Size of the per-handle write buffer. Zero disables buffering.
+var WriteBuffer = 64<<10
+
+// An open file. Sequential writes are buffered, until the buffer is full, the
+// node is read or looked at, or the file is flushed.
+type OpFile struct{
+	nodefs.File
+	Node *OpNode
+	// The flags, the file has been opened with.
+	Flags uint32
+	
+	lock   sync.Mutex
+	buf    []byte
+	bufOff int64
+	// The first failed write back, reported by the next Flush.
+	err    error
+	closed bool
+}
+func (f *OpFile) String() string {
+	return "OpFile("+f.Node.ID.String()+")"
+}
+func (f *OpFile) readable() bool {
+	return (int(f.Flags)&syscall.O_ACCMODE)!=os.O_WRONLY
+}
+func (f *OpFile) writable() bool {
+	return (int(f.Flags)&syscall.O_ACCMODE)!=os.O_RDONLY
+}
+func (f *OpFile) appending() bool {
+	return (f.Flags&uint32(os.O_APPEND))!=0
+}
+// Writes the buffer to the facade.
+func (f *OpFile) flushLocked() error {
+	if len(f.buf)==0 { return nil }
+	f.Node.dropStat()
+	_,e := f.Node.Facade.WriteAt(f.Node.ID,f.buf,f.bufOff)
+	f.buf = f.buf[:0]
+	if e!=nil && f.err==nil { f.err = e }
+	return e
+}
+func (f *OpFile) writeBack() fuse.Status {
+	f.lock.Lock(); defer f.lock.Unlock()
+	return toStatus(f.flushLocked())
+}
+// Reads see the buffered writes of every handle of the node.
+func (f *OpFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if c := f.Node.writeBack(); !c.Ok() { return nil,c }
+	f.lock.Lock(); defer f.lock.Unlock()
+	if f.closed || !f.readable() { return nil,fuse.EBADF }
+	return f.Node.read(dest,off)
+}
+// Writes, that bypass the buffer, go after the buffered writes of every handle
+// of the node, so these can't overwrite them later.
+func (f *OpFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if f.appending() || len(data)>=WriteBuffer {
+		if c := f.Node.writeBack(); !c.Ok() { return 0,c }
+	}
+	f.lock.Lock(); defer f.lock.Unlock()
+	if f.closed || !f.writable() { return 0,fuse.EBADF }
+	if f.appending() {
+		if e := f.flushLocked(); e!=nil { return 0,toStatus(e) }
+		return f.Node.append(data)
+	}
+	end := f.bufOff+int64(len(f.buf))
+	if len(f.buf)>0 && (off!=end || len(f.buf)+len(data)>WriteBuffer) {
+		if e := f.flushLocked(); e!=nil { return 0,toStatus(e) }
+	}
+	if len(data)>=WriteBuffer { return f.Node.write(data,off) }
+	if len(f.buf)==0 { f.bufOff = off }
+	f.buf = append(f.buf,data...)
+	return uint32(len(data)),fuse.OK
+}
+// Called on every close(2) of the file. Reports failed write backs.
+func (f *OpFile) Flush() fuse.Status {
+	f.lock.Lock(); defer f.lock.Unlock()
+	f.flushLocked()
+	e := f.err
+	f.err = nil
+	return toStatus(e)
+}
+func (f *OpFile) Release() {
+	f.lock.Lock(); defer f.lock.Unlock()
+	f.flushLocked()
+	f.closed = true
+	f.buf = nil
+	f.Node.forgetFile(f)
+	f.Node.dropStat()
+}
+// Syncs the writes of every handle of the node. Bit 0 of the flags
+// (FUSE_FSYNC_FDATASYNC) requests fdatasync. Directories can't be synced
+// through FUSE: nodefs answers FSYNCDIR with ENOSYS.
+func (f *OpFile) Fsync(flags int) fuse.Status {
+	if c := f.Node.writeBack(); !c.Ok() { return c }
+	f.lock.Lock(); defer f.lock.Unlock()
+	if f.closed { return fuse.EBADF }
+	return toStatus(f.Node.Facade.Fsync(f.Node.ID,(flags&1)!=0))
+}
@@ -0,0 +1,97 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package fusebind
+
+import "golang.org/x/sys/unix"
+import "os"
+import "runtime"
+import "syscall"
+import "testing"
+
+// Runs f with the file system uid and gid of another user, which the kernel
+// checks the permission bits against.
+func asUser(t *testing.T,id int,f func()) {
+	if os.Getuid()!=0 { t.Skip("not root") }
+	runtime.LockOSThread()
+	syscall.Setfsuid(id)
+	syscall.Setfsgid(id)
+	defer func() {
+		syscall.Setfsuid(0)
+		syscall.Setfsgid(0)
+		runtime.UnlockOSThread()
+	}()
+	f()
+}
+
+func TestMountPermissions(t *testing.T) {
+	d,_ := mount(t)
+	if e := os.Mkdir(d+"private",0700); e!=nil { t.Fatal(e) }
+	if e := os.WriteFile(d+"private/file",nil,0600); e!=nil { t.Fatal(e) }
+	if e := os.WriteFile(d+"shared",nil,0644); e!=nil { t.Fatal(e) }
+	if e := os.Chmod(d,0777); e!=nil { t.Fatal(e) }
+	
+	asUser(t,65534,func() {
+		_,e := os.Stat(d+"private/file")
+		expect(t,"stat",e,syscall.EACCES)
+		_,e = os.OpenFile(d+"shared",os.O_WRONLY,0)
+		expect(t,"open",e,syscall.EACCES)
+		expect(t,"mkdir",syscall.Mkdir(d+"private/sub",0755),syscall.EACCES)
+		if e = syscall.Mkdir(d+"mine",0750); e!=nil { t.Fatal(e) }
+	})
+	st,e := os.Stat(d+"mine")
+	if e!=nil { t.Fatal(e) }
+	if sys := st.Sys().(*syscall.Stat_t); sys.Uid!=65534 || st.Mode().Perm()&^0750!=0 {
+		t.Errorf("mode %v, owner %d",st.Mode(),sys.Uid)
+	}
+}
+
+func readName(t *testing.T,fn string) string {
+	t.Helper()
+	b,e := os.ReadFile(fn)
+	if e!=nil { t.Fatal(e) }
+	return string(b)
+}
+
+// The flags of renameat2(2) reach the facade.
+func TestMountRenameFlags(t *testing.T) {
+	d,_ := mount(t)
+	for _,n := range []string{"a","b","dir/x"} {
+		if n=="dir/x" { os.Mkdir(d+"dir",0755) }
+		if e := os.WriteFile(d+n,[]byte(n),0644); e!=nil { t.Fatal(e) }
+	}
+	rename := func(o,n string,flags uint) error { return unix.Renameat2(unix.AT_FDCWD,d+o,unix.AT_FDCWD,d+n,flags) }
+	
+	expect(t,"noreplace",rename("a","b",unix.RENAME_NOREPLACE),syscall.EEXIST)
+	if e := rename("a","c",unix.RENAME_NOREPLACE); e!=nil { t.Fatal(e) }
+	if _,e := os.Stat(d+"a"); !os.IsNotExist(e) { t.Fatal(e) }
+	
+	if e := rename("c","b",unix.RENAME_EXCHANGE); e!=nil { t.Fatal(e) }
+	if readName(t,d+"b")!="a" || readName(t,d+"c")!="b" { t.Error("not exchanged") }
+	if e := rename("dir/x","b",unix.RENAME_EXCHANGE); e!=nil { t.Fatal(e) }
+	if readName(t,d+"b")!="dir/x" || readName(t,d+"dir/x")!="a" { t.Error("not exchanged") }
+	expect(t,"exchange",rename("c","missing",unix.RENAME_EXCHANGE),syscall.ENOENT)
+	expect(t,"both",rename("c","b",unix.RENAME_EXCHANGE|unix.RENAME_NOREPLACE),syscall.EINVAL)
+}
@@ -0,0 +1,185 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package fusebind
+
+import "github.com/byte-mug/quickfs"
+import "github.com/hanwen/go-fuse/fuse"
+import "github.com/hanwen/go-fuse/fuse/nodefs"
+import "github.com/nu7hatch/gouuid"
+import "errors"
+import "io/ioutil"
+import "os"
+import "sync/atomic"
+import "syscall"
+import "testing"
+
+// Mounts a memfs-backed volume in-process. The test is skipped, where FUSE
+// is not available. Only plain syscalls may be used on the mount, as a
+// forked process could deadlock against the server in this process.
+func mount(t *testing.T) (string,*OpNode) {
+	m := new(quickfs.MemFileSystem).Init()
+	m.Mkdir(uuid.NamespaceURL)
+	return mountFacade(t,&quickfs.HL_Wrap{LL_Facade:m})
+}
+func mountFacade(t *testing.T,f quickfs.Facade2) (string,*OpNode) {
+	root := NewOpNode(f,uuid.NamespaceURL)
+	dir,e := ioutil.TempDir("","fusebind")
+	if e!=nil { t.Fatal(e) }
+	conn := nodefs.NewFileSystemConnector(root,nil)
+	srv,e := fuse.NewServer(RawFS(conn),dir,&fuse.MountOptions{DirectMount:true,Options:[]string{"default_permissions"}})
+	if e!=nil {
+		os.Remove(dir)
+		t.Skip("fuse not available:",e)
+	}
+	go srv.Serve()
+	if e = srv.WaitMount(); e!=nil { t.Fatal(e) }
+	t.Cleanup(func() {
+		srv.Unmount()
+		os.Remove(dir)
+	})
+	return dir+"/",root
+}
+
+func expect(t *testing.T,what string,e error,errno syscall.Errno) {
+	t.Helper()
+	if !errors.Is(e,errno) { t.Errorf("%s: got %v, want %v",what,e,errno) }
+}
+
+func TestMountStatus(t *testing.T) {
+	d,_ := mount(t)
+	
+	_,e := os.Stat(d+"missing")
+	expect(t,"stat",e,syscall.ENOENT)
+	expect(t,"unlink",syscall.Unlink(d+"missing"),syscall.ENOENT)
+	
+	if e = os.Mkdir(d+"dir",0755); e!=nil { t.Fatal(e) }
+	expect(t,"mkdir",os.Mkdir(d+"dir",0755),syscall.EEXIST)
+	if e = ioutil.WriteFile(d+"dir/file",[]byte("hello"),0644); e!=nil { t.Fatal(e) }
+	_,e = os.OpenFile(d+"dir/file",os.O_CREATE|os.O_EXCL|os.O_WRONLY,0644)
+	expect(t,"create",e,syscall.EEXIST)
+	expect(t,"link",os.Link(d+"dir/file",d+"dir"),syscall.EEXIST)
+	
+	expect(t,"rmdir",syscall.Rmdir(d+"dir"),syscall.ENOTEMPTY)
+	expect(t,"rmdir",syscall.Rmdir(d+"dir/file"),syscall.ENOTDIR)
+	expect(t,"unlink",syscall.Unlink(d+"dir"),syscall.EISDIR)
+	if e = os.Mkdir(d+"other",0755); e!=nil { t.Fatal(e) }
+	expect(t,"rename",syscall.Rename(d+"other",d+"dir"),syscall.ENOTEMPTY)
+	expect(t,"rename",syscall.Rename(d+"other",d+"dir/file"),syscall.ENOTDIR)
+	
+	b,e := ioutil.ReadFile(d+"dir/file")
+	if e!=nil || string(b)!="hello" { t.Fatal(string(b),e) }
+	if e = os.Link(d+"dir/file",d+"link"); e!=nil { t.Fatal(e) }
+	var st syscall.Stat_t
+	if e = syscall.Stat(d+"link",&st); e!=nil || st.Nlink!=2 { t.Fatal(st.Nlink,e) }
+	if e = os.Remove(d+"dir/file"); e!=nil { t.Fatal(e) }
+	if e = syscall.Rmdir(d+"dir"); e!=nil { t.Fatal(e) }
+}
+
+func TestMountAccess(t *testing.T) {
+	d,root := mount(t)
+	if e := os.Mkdir(d+"private",0700); e!=nil { t.Fatal(e) }
+	if e := ioutil.WriteFile(d+"private/file",nil,0600); e!=nil { t.Fatal(e) }
+	
+	// Mode and owner are set, when the node is created.
+	p := root.Inode().GetChild("private").Node().(*OpNode)
+	f := p.Inode().GetChild("file").Node().(*OpNode)
+	var sb quickfs.Statbuf
+	if e := f.Facade.HL_Stat(f.ID,&sb); e!=nil { t.Fatal(e) }
+	if sb.Mode!=0600 || sb.Uid!=uint32(os.Getuid()) { t.Errorf("mode %o, owner %d",sb.Mode,sb.Uid) }
+	
+	// Hard links can't cross volumes.
+	m := new(quickfs.MemFileSystem).Init()
+	m.Mkdir(uuid.NamespaceURL)
+	other := NewOpNode(&quickfs.HL_Wrap{LL_Facade:m},uuid.NamespaceURL)
+	_,c := root.Link("x",other,nil)
+	if c!=fuse.EXDEV { t.Errorf("link: got %v, want EXDEV",c) }
+}
+
+// Writes, that bypass the buffer, must not be overwritten by older buffered
+// writes of another handle.
+func TestMountWriteOrder(t *testing.T) {
+	d,_ := mount(t)
+	open := func(flag int) *os.File {
+		f,e := os.OpenFile(d+"file",os.O_CREATE|os.O_WRONLY|flag,0644)
+		if e!=nil { t.Fatal(e) }
+		return f
+	}
+	check := func(want string) {
+		t.Helper()
+		b,e := ioutil.ReadFile(d+"file")
+		if e!=nil { t.Fatal(e) }
+		if string(b)!=want { t.Errorf("got %.20q (%d bytes), want %.20q (%d bytes)",b,len(b),want,len(want)) }
+	}
+	
+	buffered,appender := open(0),open(os.O_APPEND)
+	buffered.Write([]byte("aaaa"))
+	appender.Write([]byte("bbbb"))
+	buffered.Close()
+	appender.Close()
+	check("aaaabbbb")
+	
+	big := make([]byte,WriteBuffer)
+	for i := range big { big[i] = 'c' }
+	buffered,direct := open(0),open(0)
+	buffered.Write([]byte("dd"))
+	direct.Write(big)
+	if e := direct.Sync(); e!=nil { t.Fatal(e) }
+	buffered.Close()
+	direct.Close()
+	check(string(big))
+}
+
+// Counts the lookups, that go to the facade.
+type countingFacade struct {
+	*quickfs.HL_Wrap
+	lookups int32
+}
+func (c *countingFacade) Lookup(id *uuid.UUID,name string) (*uuid.UUID,error) {
+	atomic.AddInt32(&c.lookups,1)
+	return c.HL_Wrap.Lookup(id,name)
+}
+
+// Listed children are looked up without asking the facade again.
+func TestMountListing(t *testing.T) {
+	m := new(quickfs.MemFileSystem).Init()
+	m.Mkdir(uuid.NamespaceURL)
+	c := &countingFacade{HL_Wrap:&quickfs.HL_Wrap{LL_Facade:m}}
+	d,_ := mountFacade(t,c)
+	for _,name := range []string{"a","b","c"} {
+		if _,e := c.HL_Mkfile(uuid.NamespaceURL,name,quickfs.CreateExclusive); e!=nil { t.Fatal(e) }
+	}
+	atomic.StoreInt32(&c.lookups,0)
+	ents,e := ioutil.ReadDir(d)
+	if e!=nil { t.Fatal(e) }
+	if len(ents)!=3 { t.Fatal(len(ents)) }
+	if n := atomic.LoadInt32(&c.lookups); n!=0 { t.Errorf("%d lookups",n) }
+	
+	// A removed child is not served from the listing.
+	ioutil.ReadDir(d)
+	if e = os.Remove(d+"a"); e!=nil { t.Fatal(e) }
+	_,e = os.Lstat(d+"a")
+	expect(t,"lstat",e,syscall.ENOENT)
+}
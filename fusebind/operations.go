@@ -30,34 +30,46 @@ import "github.com/hanwen/go-fuse/fuse"
 import "github.com/hanwen/go-fuse/fuse/nodefs"
 
 import "github.com/nu7hatch/gouuid"
+import "io"
 import "os"
+import "sync"
+import "syscall"
 import "time"
 
 import "fmt"
 
+func modeOf(sb *quickfs.Statbuf) uint32 {
+	switch {
+	case sb.IsDir: return fuse.S_IFDIR|sb.Mode
+	case sb.IsRegular: return fuse.S_IFREG|sb.Mode
+	case sb.IsSymlink: return fuse.S_IFLNK|sb.Mode
+	}
+	return sb.Mode
+}
 func setAttr(attr *fuse.Attr,sb *quickfs.Statbuf) {
 	attr.Size = uint64(sb.Size)
-	if sb.IsDir {
-		attr.Mode = fuse.S_IFDIR|0777
-	}else if sb.IsRegular {
-		attr.Mode = fuse.S_IFREG|0666
-	}
-	t := sb.ModTime
-	attr.SetTimes(&t,&t,&t)
+	attr.Ino = sb.Ino
+	attr.Mode = modeOf(sb)
+	attr.Owner = fuse.Owner{Uid:sb.Uid,Gid:sb.Gid}
+	attr.Nlink = sb.Nlink
+	if attr.Nlink==0 { attr.Nlink = 1 }
+	m,a,c := sb.ModTime,sb.Atime,sb.Ctime
+	// Servers, that predate Atime and Ctime, leave them zero.
+	if a.IsZero() { a = m }
+	if c.IsZero() { c = m }
+	attr.SetTimes(&a,&m,&c)
+}
+// Translates an error of the facade into a FUSE status.
+func toStatus(e error) fuse.Status {
+	if e==nil { return fuse.OK }
+	if en := quickfs.CodeOf(e).Errno(); en!=0 { return fuse.Status(en) }
+	return fuse.EIO
 }
 func istrunc(flags uint32) bool {
 	return (flags&uint32(os.O_TRUNC))!=0
 }
 func isIllegal(name string) bool {
-	switch name{
-	case "",".","..": return true
-	}
-	for _,b := range []byte(name) {
-		switch b {
-		case '/','\\': return true
-		}
-	}
-	return false
+	return quickfs.IllegalName(name)
 }
 
 var Debug = false
@@ -67,113 +79,372 @@ func debugln(i ...interface{}) {
 	}
 }
 
+// Attributes, that came with a directory listing, are used by the next
+// GetAttr, if it follows within this time.
+var StatCacheTime = time.Second
+
+// Number of entries OpenDir fetches per call.
+var ReaddirPage = 1024
+
+// A node of a mounted volume. Mount it with the "default_permissions" option,
+// so that the kernel enforces the permission bits, OpNode does not check them.
 type OpNode struct{
 	nodefs.Node
 	Facade quickfs.Facade2
 	ID *uuid.UUID
+	
+	lock sync.Mutex
+	stat quickfs.Statbuf
+	statAt time.Time
+	
+	// The open files, whose buffers must be written back, before the node
+	// is looked at. Protected by lock.
+	files map[*OpFile]bool
+	
+	// The entries of the last listing, that Lookup may use within
+	// StatCacheTime. Protected by lock.
+	listed   map[string]*quickfs.DirEntry
+	listedAt time.Time
 }
 
 // Wraps a QuickFS facade into a fuse nodefs.Node.
 func NewOpNode(fs quickfs.Facade2,id *uuid.UUID) *OpNode {
-	return &OpNode{nodefs.NewDefaultNode(),fs,id}
+	return &OpNode{Node:nodefs.NewDefaultNode(),Facade:fs,ID:id}
+}
+func (n *OpNode) cacheStat(sb *quickfs.Statbuf) {
+	n.lock.Lock(); defer n.lock.Unlock()
+	n.stat,n.statAt = *sb,time.Now()
+}
+func (n *OpNode) dropStat() {
+	n.lock.Lock(); defer n.lock.Unlock()
+	n.statAt = time.Time{}
+}
+// Uses the cached attributes once, or asks the facade.
+func (n *OpNode) getStat(sb *quickfs.Statbuf) error {
+	n.lock.Lock()
+	ok := time.Since(n.statAt)<StatCacheTime
+	if ok { *sb,n.statAt = n.stat,time.Time{} }
+	n.lock.Unlock()
+	if ok { return nil }
+	return n.Facade.HL_Stat(n.ID,sb)
+}
+// Uses the listed entry name once, if there is one.
+func (n *OpNode) getListed(name string) *quickfs.DirEntry {
+	n.lock.Lock(); defer n.lock.Unlock()
+	ent := n.listed[name]
+	if ent==nil || time.Since(n.listedAt)>=StatCacheTime { return nil }
+	delete(n.listed,name)
+	return ent
+}
+// Called on changes of the directory, that would make the listing stale.
+func (n *OpNode) dropListed() {
+	n.lock.Lock(); defer n.lock.Unlock()
+	n.listed = nil
+}
+// Returns the known child name, if it still is the node id.
+func (n *OpNode) child(name string, id *uuid.UUID) *OpNode {
+	c := n.Inode().GetChild(name)
+	if c==nil { return nil }
+	m,ok := c.Node().(*OpNode)
+	if !ok || *m.ID!=*id { return nil }
+	return m
 }
-func (n *OpNode) asFile() nodefs.File {
-	//return &OpFile{nodefs.NewDefaultFile(),n.Facade,n.ID}
-	return nodefs.NewDefaultFile()
+// The mode of a new node, with the caller as owner.
+func newAttr(mode uint32, context *fuse.Context) *quickfs.NodeAttr {
+	a := &quickfs.NodeAttr{Mode:mode&07777,Uid:^uint32(0),Gid:^uint32(0)}
+	if context!=nil { a.Uid,a.Gid = context.Uid,context.Gid }
+	return a
 }
+func (n *OpNode) asFile(flags uint32) nodefs.File {
+	f := &OpFile{File:nodefs.NewDefaultFile(),Node:n,Flags:flags}
+	n.lock.Lock(); defer n.lock.Unlock()
+	if n.files==nil { n.files = make(map[*OpFile]bool) }
+	n.files[f] = true
+	return f
+}
+func (n *OpNode) forgetFile(f *OpFile) {
+	n.lock.Lock(); defer n.lock.Unlock()
+	delete(n.files,f)
+}
+// Writes back the buffers of all open files of the node.
+func (n *OpNode) writeBack() fuse.Status {
+	n.lock.Lock()
+	files := make([]*OpFile,0,len(n.files))
+	for f := range n.files { files = append(files,f) }
+	n.lock.Unlock()
+	code := fuse.OK
+	for _,f := range files {
+		if c := f.writeBack(); !c.Ok() { code = c }
+	}
+	return code
+}
+// Children, that have just been listed, are looked up without a round trip.
 func (n *OpNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	var sb quickfs.Statbuf
-	id,e := n.Facade.Lookup(n.ID,name)
-	if e!=nil { return nil,fuse.ENOENT }
-	if n.Facade.HL_Stat(id,&sb)!=nil { return nil,fuse.ENOENT }
-	nn := &OpNode{nodefs.NewDefaultNode(),n.Facade,id}
+	var id *uuid.UUID
+	if ent := n.getListed(name); ent!=nil {
+		id,sb = ent.Id,ent.Stat
+	}else{
+		var e error
+		id,e = n.Facade.Lookup(n.ID,name)
+		if e!=nil { return nil,toStatus(e) }
+		if e = n.Facade.HL_Stat(id,&sb); e!=nil { return nil,toStatus(e) }
+	}
 	if out!=nil { setAttr(out,&sb) }
+	if m := n.child(name,id); m!=nil { return m.Inode(),fuse.OK }
+	nn := NewOpNode(n.Facade,id)
+	nn.cacheStat(&sb)
 	return n.Inode().NewChild(name,sb.IsDir,nn),fuse.OK
 }
 func (n *OpNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
-	id,e := n.Facade.HL_Mkfile(n.ID,name)
-	if e!=nil { return nil,fuse.EIO }
-	nn := &OpNode{nodefs.NewDefaultNode(),n.Facade,id}
+	n.dropListed()
+	id,e := n.Facade.HL_MkfileAttr(n.ID,name,quickfs.CreateExclusive,newAttr(mode,context))
+	if e!=nil { return nil,toStatus(e) }
+	nn := NewOpNode(n.Facade,id)
 	return n.Inode().NewChild(name,false,nn),fuse.OK
 }
 func (n *OpNode) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
-	id,e := n.Facade.HL_Mkdir(n.ID,name)
-	if e!=nil { return nil,fuse.EIO }
-	nn := &OpNode{nodefs.NewDefaultNode(),n.Facade,id}
+	n.dropListed()
+	id,e := n.Facade.HL_MkdirAttr(n.ID,name,quickfs.CreateExclusive,newAttr(mode,context))
+	if e!=nil { return nil,toStatus(e) }
+	nn := NewOpNode(n.Facade,id)
 	return n.Inode().NewChild(name,true,nn),fuse.OK
 }
-func (n *OpNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	e := n.Facade.HL_Delete(n.ID,name)
-	if e !=nil { return fuse.ENOENT }
+// Removes a dirent, if the child is a directory exactly if dir is true.
+func (n *OpNode) remove(name string, dir bool, context *fuse.Context) fuse.Status {
+	n.dropListed()
+	var sb quickfs.Statbuf
+	id,e := n.Facade.Lookup(n.ID,name)
+	if e==nil { e = n.Facade.HL_Stat(id,&sb) }
+	if e!=nil { return toStatus(e) }
+	if sb.IsDir && !dir { return fuse.Status(syscall.EISDIR) }
+	if !sb.IsDir && dir { return fuse.ENOTDIR }
+	if dir {
+		s,_,e := n.Facade.Readdir(id,"",1)
+		if e!=nil { return toStatus(e) }
+		if len(s)>0 { return fuse.Status(syscall.ENOTEMPTY) }
+	}
+	e = n.Facade.HL_Delete(n.ID,name)
+	if e!=nil { return toStatus(e) }
 	n.Inode().RmChild(name)
 	return fuse.OK
 }
+func (n *OpNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	return n.remove(name,false,context)
+}
 func (n *OpNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return n.Unlink(name,context)
+	return n.remove(name,true,context)
+}
+func (n *OpNode) Link(name string, existing nodefs.Node, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	m,ok := existing.(*OpNode)
+	if !ok { return nil,fuse.EXDEV }
+	if m.Facade != n.Facade { return nil,fuse.EXDEV }
+	m.dropStat()
+	n.dropListed()
+	e := n.Facade.HL_Link(n.ID,name,m.ID)
+	if e!=nil { return nil,toStatus(e) }
+	n.Inode().AddChild(name,m.Inode())
+	return m.Inode(),fuse.OK
+}
+func (n *OpNode) Symlink(name string, content string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.dropListed()
+	id,e := n.Facade.HL_SymlinkAttr(n.ID,name,content,newAttr(0777,context))
+	if e!=nil { return nil,toStatus(e) }
+	nn := NewOpNode(n.Facade,id)
+	return n.Inode().NewChild(name,false,nn),fuse.OK
+}
+func (n *OpNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	s,e := n.Facade.HL_Readlink(n.ID)
+	if e!=nil { return nil,toStatus(e) }
+	return []byte(s),fuse.OK
 }
 func (n *OpNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, child *nodefs.Inode, code fuse.Status) {
-	id,e := n.Facade.HL_Mkfile(n.ID,name)
-	if e!=nil { return nil,nil,fuse.EIO }
-	nn := &OpNode{nodefs.NewDefaultNode(),n.Facade,id}
-	if istrunc(flags) { n.Facade.Truncate(n.ID,0) }
-	return nn.asFile(),n.Inode().NewChild(name,false,nn),fuse.OK
+	n.dropListed()
+	id,e := n.Facade.HL_MkfileAttr(n.ID,name,quickfs.CreateExclusive,newAttr(mode,context))
+	if e==nil {
+		nn := NewOpNode(n.Facade,id)
+		return nn.asFile(flags),n.Inode().NewChild(name,false,nn),fuse.OK
+	}
+	if quickfs.CodeOf(e)!=quickfs.CodeExist || (flags&syscall.O_EXCL)!=0 { return nil,nil,toStatus(e) }
+	
+	// Without O_EXCL, a file created since the lookup is simply opened.
+	id,e = n.Facade.HL_Mkfile(n.ID,name,quickfs.CreateOpen)
+	if e!=nil { return nil,nil,toStatus(e) }
+	var nn *OpNode
+	ch := n.Inode().GetChild(name)
+	if ch!=nil { nn,_ = ch.Node().(*OpNode) }
+	if nn==nil || *nn.ID!=*id {
+		ch = n.Inode().NewChild(name,false,NewOpNode(n.Facade,id))
+	}
+	file,code = ch.Node().Open(flags,context)
+	if !code.Ok() { return nil,nil,code }
+	return file,ch,fuse.OK
 }
 func (n *OpNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	if n.Inode().IsDir() { return nil,fuse.EIO } // EISDIR
-	if istrunc(flags) { n.Facade.Truncate(n.ID,0) }
-	return n.asFile(),fuse.OK
+	n.dropStat()
+	if n.Inode().IsDir() { return nil,fuse.Status(syscall.EISDIR) }
+	if istrunc(flags) {
+		if e := n.Facade.Truncate(n.ID,0); e!=nil { return nil,toStatus(e) }
+	}
+	return n.asFile(flags),fuse.OK
 }
 
 func (n *OpNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	s,e := n.Facade.Readdirnames(n.ID)
-	if e!=nil { return nil,fuse.ENOTDIR }
-	buf := make([]fuse.DirEntry,0,len(s))
-	for _,name := range s {
-		if isIllegal(name) { continue }
-		buf = append(buf,fuse.DirEntry{Name:name})
+	// nodefs wants the whole listing at once, but it is fetched page by page.
+	// Children known to the kernel get their attributes cached, the others
+	// are kept for Lookup. They are not added to the tree, as the kernel
+	// would never forget them.
+	var buf []fuse.DirEntry
+	listed := make(map[string]*quickfs.DirEntry)
+	at := time.Now()
+	cookie := ""
+	for {
+		ents,next,e := n.Facade.HL_ReadDirPlus(n.ID,cookie,ReaddirPage)
+		if e!=nil { return nil,toStatus(e) }
+		for i := range ents {
+			ent := &ents[i]
+			if isIllegal(ent.Name) { continue }
+			if m := n.child(ent.Name,ent.Id); m!=nil {
+				m.cacheStat(&ent.Stat)
+			}else{
+				listed[ent.Name] = ent
+			}
+			buf = append(buf,fuse.DirEntry{Name:ent.Name,Mode:modeOf(&ent.Stat),Ino:ent.Stat.Ino})
+		}
+		if next=="" { break }
+		cookie = next
 	}
+	n.lock.Lock()
+	n.listed,n.listedAt = listed,at
+	n.lock.Unlock()
 	return buf,fuse.OK
 }
+// I/O on an open file goes through its OpFile.
 func (n *OpNode) Read(file nodefs.File, dest []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	if f,ok := file.(*OpFile); ok { return f.Read(dest,off) }
+	return n.read(dest,off)
+}
+func (n *OpNode) Write(file nodefs.File, data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status) {
+	if f,ok := file.(*OpFile); ok { return f.Write(data,off) }
+	return n.write(data,off)
+}
+func (n *OpNode) read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	b,e := n.Facade.HL_ReadAt(n.ID,dest,off)
-	if e!=nil && len(b)==0 { return nil,fuse.EIO }
+	if e!=nil && e!=io.EOF && len(b)==0 { return nil,toStatus(e) }
 	return fuse.ReadResultData(b),fuse.OK
 }
-func (n *OpNode) Write(file nodefs.File, data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status) {
+func (n *OpNode) write(data []byte, off int64) (uint32, fuse.Status) {
+	n.dropStat()
 	r,e := n.Facade.WriteAt(n.ID,data,off)
-	if e!=nil { return uint32(r),fuse.EIO }
+	if e!=nil { return uint32(r),toStatus(e) }
 	return uint32(r),fuse.OK
 }
 func (n *OpNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
 	var sb quickfs.Statbuf
-	if n.Facade.HL_Stat(n.ID,&sb)!=nil { return fuse.ENOENT }
+	// The size must include buffered writes.
+	n.writeBack()
+	if e := n.getStat(&sb); e!=nil { return toStatus(e) }
 	if out!=nil { setAttr(out,&sb) }
 	return fuse.OK
 }
+// Only the owner (or root) may change the mode.
+func (n *OpNode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) (code fuse.Status) {
+	n.dropStat()
+	var sb quickfs.Statbuf
+	if e := n.Facade.HL_Stat(n.ID,&sb); e!=nil { return toStatus(e) }
+	if context!=nil && context.Uid!=0 && context.Uid!=sb.Uid { return fuse.EPERM }
+	e := n.Facade.HL_Chmod(n.ID,perms&07777)
+	if e!=nil { return toStatus(e) }
+	return fuse.OK
+}
+// Only root may change the owner. The owner may change the group to its own.
+func (n *OpNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	n.dropStat()
+	var sb quickfs.Statbuf
+	if e := n.Facade.HL_Stat(n.ID,&sb); e!=nil { return toStatus(e) }
+	if context!=nil && context.Uid!=0 {
+		if uid!=^uint32(0) && uid!=sb.Uid { return fuse.EPERM }
+		if context.Uid!=sb.Uid { return fuse.EPERM }
+		if gid!=^uint32(0) && gid!=sb.Gid && gid!=context.Gid { return fuse.EPERM }
+	}
+	e := n.Facade.HL_Chown(n.ID,uid,gid)
+	if e!=nil { return toStatus(e) }
+	return fuse.OK
+}
+func xattrStatus(e error) fuse.Status {
+	if quickfs.CodeOf(e)==quickfs.CodeNoData { return fuse.ENOATTR }
+	return toStatus(e)
+}
+func (n *OpNode) xattrs() (quickfs.XAttrFacade,fuse.Status) {
+	x,ok := n.Facade.(quickfs.XAttrFacade)
+	if !ok { return nil,fuse.ENOSYS }
+	return x,fuse.OK
+}
+func (n *OpNode) GetXAttr(attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	x,c := n.xattrs()
+	if !c.Ok() { return nil,c }
+	data,e := x.GetXAttr(n.ID,attribute)
+	return data,xattrStatus(e)
+}
+func (n *OpNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	x,c := n.xattrs()
+	if !c.Ok() { return c }
+	return xattrStatus(x.SetXAttr(n.ID,attr,data,flags))
+}
+func (n *OpNode) ListXAttr(context *fuse.Context) (attrs []string, code fuse.Status) {
+	x,c := n.xattrs()
+	if !c.Ok() { return nil,c }
+	attrs,e := x.ListXAttr(n.ID)
+	return attrs,xattrStatus(e)
+}
+func (n *OpNode) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
+	x,c := n.xattrs()
+	if !c.Ok() { return c }
+	return xattrStatus(x.RemoveXAttr(n.ID,attr))
+}
 func (n *OpNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
+	if c := n.writeBack(); !c.Ok() { return c }
+	n.dropStat()
 	e := n.Facade.Truncate(n.ID,int64(size))
-	if e!=nil { return fuse.EIO }
+	if e!=nil { return toStatus(e) }
 	return fuse.OK
 }
+// A nil time is left unchanged.
 func (n *OpNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	n.dropStat()
+	if atime==nil || mtime==nil {
+		var sb quickfs.Statbuf
+		if e := n.Facade.HL_Stat(n.ID,&sb); e!=nil { return toStatus(e) }
+		if atime==nil { atime = &sb.Atime }
+		if mtime==nil { mtime = &sb.ModTime }
+	}
 	e := n.Facade.Chtimes(n.ID,*atime,*mtime)
-	if e!=nil { return fuse.EIO }
+	if e!=nil { return toStatus(e) }
 	return fuse.OK
 }
+// The flags of renameat2(2) only get here, if the mount serves RawFS(conn).
+// Otherwise nodefs answers RENAME_NOREPLACE and RENAME_EXCHANGE with ENOSYS.
 func (n *OpNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) (code fuse.Status) {
 	m,ok := newParent.(*OpNode)
-	if !ok { return fuse.EIO }
-	if m.Facade != n.Facade { return fuse.EIO }
-	e := n.Facade.HL_Movelink(n.ID,oldName,m.ID,newName)
-	if e!=nil { return fuse.EIO }
+	if !ok { return fuse.EXDEV }
+	if m.Facade != n.Facade { return fuse.EXDEV }
+	n.dropListed()
+	m.dropListed()
+	flags := renameFlagsOf(context)
+	e := n.Facade.HL_Movelink(n.ID,oldName,m.ID,newName,flags)
+	if e!=nil { return toStatus(e) }
+	
+	// Keep the inode tree in line.
+	ch := n.Inode().RmChild(oldName)
+	other := m.Inode().RmChild(newName)
+	if ch!=nil { m.Inode().AddChild(newName,ch) }
+	if other!=nil && (flags&quickfs.RenameExchange)!=0 { n.Inode().AddChild(oldName,other) }
 	return fuse.OK
 }
 
-/*
-type OpFile struct{
-	nodefs.File
-	Facade quickfs.Facade2
-	ID *uuid.UUID
+// Writes at the end of the file, which the facade determines atomically.
+func (n *OpNode) append(data []byte) (uint32, fuse.Status) {
+	n.dropStat()
+	if _,e := n.Facade.Append(n.ID,data); e!=nil { return 0,toStatus(e) }
+	return uint32(len(data)),fuse.OK
 }
-*/
-
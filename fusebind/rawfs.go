@@ -0,0 +1,64 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package fusebind
+
+import "github.com/byte-mug/quickfs"
+import "github.com/hanwen/go-fuse/fuse"
+import "github.com/hanwen/go-fuse/fuse/nodefs"
+
+import "sync"
+
+// The flags of the renames in flight, by the cancel channel of their request.
+// nodefs passes that on to OpNode.Rename in the fuse.Context, but not the
+// flags.
+var renameFlags sync.Map
+
+type rawFS struct {
+	fuse.RawFileSystem
+}
+
+// Wraps conn.RawFS(), so that renameat2(2) with RENAME_NOREPLACE or
+// RENAME_EXCHANGE reaches OpNode.Rename, instead of being refused by nodefs
+// with ENOSYS. Serve this instead of conn.RawFS().
+func RawFS(conn *nodefs.FileSystemConnector) fuse.RawFileSystem {
+	return &rawFS{conn.RawFS()}
+}
+
+func (r *rawFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if input.Flags==0 || cancel==nil { return r.RawFileSystem.Rename(cancel,input,oldName,newName) }
+	if (input.Flags&^(quickfs.RenameNoReplace|quickfs.RenameExchange))!=0 { return fuse.EINVAL }
+	in := *input
+	in.Flags = 0
+	renameFlags.Store(cancel,int(input.Flags))
+	defer renameFlags.Delete(cancel)
+	return r.RawFileSystem.Rename(cancel,&in,oldName,newName)
+}
+
+func renameFlagsOf(context *fuse.Context) int {
+	if context==nil || context.Cancel==nil { return 0 }
+	if f,ok := renameFlags.Load(context.Cancel); ok { return f.(int) }
+	return 0
+}
@@ -0,0 +1,263 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "errors"
+import "os"
+import "time"
+
+// Returned by GC.Run, if not every directory could be scanned. Nothing is
+// swept then, as the nodes below them would be taken for orphans.
+var ErrGCIncomplete = errors.New("quickfs: gc mark phase incomplete, nothing swept")
+
+// The MinAge used, if none is set.
+const DefaultGCMinAge = time.Hour
+
+// A mark-and-sweep garbage collector for nodes, that are not reachable from
+// the root directory, for example because of a crash or a failed operation.
+//
+// The GC may run on a live store, if it is served through the same
+// *FileSystem: nodes created or linked meanwhile are recorded, and they and
+// the nodes below them are kept. Other processes must not use the store
+// while it runs, and only one GC may run at a time.
+type GC struct {
+	FS   *CachedFileSystem
+	Root *uuid.UUID
+	
+	// Only report the orphans, leave them untouched.
+	DryRun bool
+	
+	// Move orphans into the ".quarantine" directory of the backing store,
+	// instead of deleting them.
+	Quarantine bool
+	
+	// Maximum number of directories scanned or orphans swept per second.
+	// Zero means unlimited.
+	Rate int
+	
+	// Orphans, that have been modified within MinAge, are left alone, as
+	// they might belong to an operation in progress. Zero means
+	// DefaultGCMinAge, a negative value disables the check.
+	MinAge time.Duration
+	
+	last time.Time
+}
+
+type GCReport struct {
+	Reachable int
+	Orphans   []*uuid.UUID
+	Swept     int
+	Errors    []error
+}
+
+func (g *GC) wait() {
+	if g.Rate<=0 { return }
+	d := time.Second/time.Duration(g.Rate) - time.Since(g.last)
+	if d>0 { time.Sleep(d) }
+	g.last = time.Now()
+}
+
+func (fs *FileSystem) trackNode(id *uuid.UUID) {
+	fs.track.Lock(); defer fs.track.Unlock()
+	if fs.tracked!=nil { fs.tracked[*id] = true }
+}
+func (fs *FileSystem) setTracking(on bool) {
+	fs.track.Lock(); defer fs.track.Unlock()
+	fs.tracked = nil
+	if on { fs.tracked = make(map[uuid.UUID]bool) }
+}
+// Returns the nodes recorded since the last call.
+func (fs *FileSystem) takeTracked() []*uuid.UUID {
+	fs.track.Lock(); defer fs.track.Unlock()
+	ids := make([]*uuid.UUID,0,len(fs.tracked))
+	for id := range fs.tracked {
+		nid := id
+		ids = append(ids,&nid)
+	}
+	fs.tracked = make(map[uuid.UUID]bool)
+	return ids
+}
+
+// A node to scan, and the dirent it has been found by.
+type gcItem struct {
+	id     *uuid.UUID
+	parent *uuid.UUID
+	name   string
+}
+
+// Reports, whether an error on the node of it is explained by a concurrent
+// change: its dirent is gone or points elsewhere by now. A node moved away is
+// recorded, and scanned on its own.
+func (g *GC) vanished(it gcItem,e error) bool {
+	if !os.IsNotExist(e) || it.parent==nil { return false }
+	cid,e := g.FS.Lookup(it.parent,it.name)
+	if e!=nil { return os.IsNotExist(e) }
+	return *cid!=*it.id
+}
+
+// Marks the nodes in queue and everything below them.
+func (g *GC) scan(marked map[uuid.UUID]bool,queue []gcItem,r *GCReport) {
+	for len(queue)>0 {
+		it := queue[0]
+		queue = queue[1:]
+		fi,e := g.FS.Stat(it.id)
+		if e==nil && !fi.IsDir() { continue }
+		g.wait()
+		var names []string
+		if e==nil { names,e = g.FS.Readdirnames(it.id) }
+		if e!=nil {
+			if !g.vanished(it,e) { r.Errors = append(r.Errors,e) }
+			continue
+		}
+		for _,name := range names {
+			cid,e := g.FS.Lookup(it.id,name)
+			if e!=nil {
+				if !os.IsNotExist(e) { r.Errors = append(r.Errors,e) }
+				continue
+			}
+			if marked[*cid] { continue }
+			marked[*cid] = true
+			queue = append(queue,gcItem{cid,it.id,name})
+		}
+	}
+}
+
+func (g *GC) mark(r *GCReport) (map[uuid.UUID]bool,error) {
+	marked := map[uuid.UUID]bool{ *g.Root:true }
+	
+	// Nodes of operations in progress are alive.
+	p,e := g.FS.Journal().Pending()
+	if e!=nil { return nil,e }
+	var queue []gcItem
+	for _,in := range p {
+		for _,id := range []*uuid.UUID{in.Child,in.Other} {
+			if id==nil || marked[*id] { continue }
+			marked[*id] = true
+			queue = append(queue,gcItem{id:id})
+		}
+	}
+	g.scan(marked,append(queue,gcItem{id:g.Root}),r)
+	g.markTracked(marked,r)
+	return marked,nil
+}
+// Marks the nodes created or linked since the last call, and everything
+// below them. Those, that are gone meanwhile, are ignored.
+func (g *GC) markTracked(marked map[uuid.UUID]bool,r *GCReport) {
+	for {
+		ids := g.FS.takeTracked()
+		if len(ids)==0 { return }
+		var queue []gcItem
+		for _,id := range ids {
+			if marked[*id] { continue }
+			marked[*id] = true
+			if _,e := g.FS.Stat(id); e==nil { queue = append(queue,gcItem{id:id}) }
+		}
+		var r2 GCReport
+		g.scan(marked,queue,&r2)
+		for _,e := range r2.Errors {
+			if !os.IsNotExist(e) { r.Errors = append(r.Errors,e) }
+		}
+	}
+}
+
+func (g *GC) sweep(id *uuid.UUID) error {
+	if g.Quarantine {
+		q := g.FS.Prefix+".quarantine"
+		if e := os.MkdirAll(q,0700); e!=nil { return e }
+		g.FS.forget(id)
+		return moveNode(g.FS.extrude(id),q+"/"+id.String())
+	}
+	fi,e := g.FS.Stat(id)
+	if e!=nil { return e }
+	if fi.IsDir() {
+		// Children are unreachable as well, and swept on their own, unless
+		// they are linked elsewhere. These only lose a link.
+		names,e := g.FS.Readdirnames(id)
+		if e!=nil { return e }
+		for _,name := range names {
+			if g.linked(id,name) {
+				e = g.FS.DelDirentFull(id,name)
+			} else {
+				e = g.FS.DelDirent(id,name)
+			}
+			if e!=nil { return e }
+		}
+	}
+	return g.FS.DelNode(id)
+}
+// Reports, whether the dirent points to a node other than a directory, that
+// has further links.
+func (g *GC) linked(id *uuid.UUID,name string) bool {
+	cid,e := g.FS.Lookup(id,name)
+	if e!=nil { return false }
+	st,e := g.FS.Stat(cid)
+	if e!=nil || st.IsDir() { return false }
+	var sb Statbuf
+	sb.FromFileInfo(st)
+	return sb.Nlink>1
+}
+
+// Runs a full collection cycle.
+func (g *GC) Run() (*GCReport,error) {
+	r := new(GCReport)
+	start := time.Now()
+	minAge := g.MinAge
+	if minAge==0 { minAge = DefaultGCMinAge }
+	g.FS.setTracking(true)
+	defer g.FS.setTracking(false)
+	marked,e := g.mark(r)
+	if e!=nil { return r,e }
+	if len(r.Errors)>0 { return r,ErrGCIncomplete }
+	
+	var orphans []*uuid.UUID
+	e = g.FS.WalkNodes(func(id *uuid.UUID) error {
+		if !marked[*id] { orphans = append(orphans,id) }
+		return nil
+	})
+	if e!=nil { return r,e }
+	
+	for _,id := range orphans {
+		g.wait()
+		// Nodes linked meanwhile are alive after all.
+		g.markTracked(marked,r)
+		if len(r.Errors)>0 { return r,ErrGCIncomplete }
+		if marked[*id] { continue }
+		fi,e := g.FS.Stat(id)
+		if e!=nil { continue }
+		if minAge>0 && fi.ModTime().After(start.Add(-minAge)) { continue }
+		r.Orphans = append(r.Orphans,id)
+		if g.DryRun { continue }
+		if e = g.sweep(id); e!=nil {
+			r.Errors = append(r.Errors,e)
+		}else{
+			r.Swept++
+		}
+	}
+	r.Reachable = len(marked)
+	return r,nil
+}
+
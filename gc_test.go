@@ -0,0 +1,93 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "testing"
+import "time"
+
+// Moves directories around, while the GC runs on the same store. Nothing but
+// the one real orphan may be swept.
+func TestGCLive(t *testing.T) {
+	dir,e := ioutil.TempDir("","quickfs")
+	if e!=nil { t.Fatal(e) }
+	defer os.RemoveAll(dir)
+	fs := new(CachedFileSystem).Init(&FileSystem{Prefix:dir+"/"},16)
+	defer fs.Close()
+	root := uuid.NamespaceURL
+	if e = fs.Mkdir(root); e!=nil { t.Fatal(e) }
+	h := &HL_Wrap{LL_Facade:fs}
+	
+	const dirs = 20
+	var targets []*uuid.UUID
+	for i := 0; i<dirs; i++ {
+		id,e := h.HL_Mkdir(root,fmt.Sprint("d",i),CreateExclusive)
+		if e!=nil { t.Fatal(e) }
+		if _,e = h.HL_Mkfile(id,"file",CreateExclusive); e!=nil { t.Fatal(e) }
+		id,e = h.HL_Mkdir(root,fmt.Sprint("t",i),CreateExclusive)
+		if e!=nil { t.Fatal(e) }
+		targets = append(targets,id)
+	}
+	orphan,_ := uuid.NewV4()
+	if e = fs.Mkdir(orphan); e!=nil { t.Fatal(e) }
+	
+	done := make(chan struct{})
+	moved := make(chan error,1)
+	go func() {
+		// Moves the directories into others and back, so that they are below
+		// an already scanned directory at times.
+		defer close(moved)
+		for {
+			select {
+			case <-done: return
+			default:
+			}
+			for _,back := range []bool{false,true} {
+				for i := 0; i<dirs; i++ {
+					name := fmt.Sprint("d",i)
+					src,dst := root,targets[i]
+					if back { src,dst = dst,src }
+					if e := h.HL_Movelink(src,name,dst,name,0); e!=nil { moved <- e; return }
+				}
+				time.Sleep(20*time.Millisecond)
+			}
+		}
+	}()
+	g := &GC{FS:fs,Root:root,Rate:200,MinAge:-1}
+	r,e := g.Run()
+	close(done)
+	if e2 := <-moved; e2!=nil { t.Fatal(e2) }
+	if e!=nil || len(r.Errors)!=0 { t.Fatal(e,r.Errors) }
+	if r.Swept!=1 || *r.Orphans[0]!=*orphan { t.Fatalf("swept %d, orphans %v",r.Swept,r.Orphans) }
+	for i := 0; i<dirs; i++ {
+		id,e := fs.Lookup(root,fmt.Sprint("d",i))
+		if e!=nil { t.Fatal(e) }
+		if _,e = fs.Lookup(id,"file"); e!=nil { t.Fatal(e) }
+	}
+}
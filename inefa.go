@@ -28,6 +28,8 @@ package quickfs
 import "github.com/nu7hatch/gouuid"
 import "time"
 import "os"
+import "sort"
+import "syscall"
 
 type Facade interface{
 	Lookup(id *uuid.UUID,name string) (*uuid.UUID,error)
@@ -35,29 +37,137 @@ type Facade interface{
 	Truncate(id *uuid.UUID,size int64) error
 	WriteAt(id *uuid.UUID, b []byte, off int64) (int,error)
 	Readdirnames(id *uuid.UUID) ([]string,error)
+	// Lists at most max names (all, if max<=0) in sorted order, starting
+	// after cookie ("" is the start). The returned cookie continues the
+	// listing, it is "" at the end. Names, that are inserted meanwhile, show
+	// up, if they sort after the cookie.
+	Readdir(id *uuid.UUID,cookie string,max int) ([]string,string,error)
+	// Makes the node durable, as fsync(2), or fdatasync(2) if dataOnly is
+	// true, including its own entry in the backend. For directories, this
+	// covers their dirents.
+	Fsync(id *uuid.UUID,dataOnly bool) error
+	// Writes b at the end of the file, atomically with respect to other
+	// appends. Returns the new end of the file.
+	Append(id *uuid.UUID, b []byte) (int64,error)
+}
+
+// Cuts a page out of names, which all sort after the cookie.
+func pageNames(names []string,max int) ([]string,string,error) {
+	sort.Strings(names)
+	if max<=0 || len(names)<=max { return names,"",nil }
+	names = names[:max]
+	return names,names[max-1],nil
 }
 
 type Statbuf struct {
 	Size int64
 	ModTime time.Time
+	// Last access, last change of data or metadata, and creation. Btime is
+	// zero, if unknown.
+	Atime time.Time
+	Ctime time.Time
+	Btime time.Time
 	IsDir bool
 	IsRegular bool
+	IsSymlink bool
+	// Number of dirents, that refer to the node.
+	Nlink uint32
+	// Inode number, stable across restarts (see InodeOf).
+	Ino uint64
+	// Permission bits (07777), owner and group.
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
 }
 func (s *Statbuf) FromFileInfo(i os.FileInfo) {
+	if sb,ok := i.Sys().(*Statbuf); ok {
+		*s = *sb
+		return
+	}
 	s.Size      = i.Size()
 	s.IsDir     = i.IsDir()
 	s.IsRegular = i.Mode().IsRegular()
 	s.ModTime   = i.ModTime()
+	s.Mode      = uint32(i.Mode().Perm())
+	hostTimes(s,i)
+}
+
+// The mode of nodes, that have none stored, as they were created before
+// modes were kept.
+func (s *Statbuf) DefaultMode() uint32 {
+	if s.IsDir || s.IsSymlink { return 0777 }
+	return 0666
+}
+
+// Wraps a Statbuf into an os.FileInfo. This is meant for backends, that are
+// not backed by the host filesystem. Sys() returns the *Statbuf.
+func (s *Statbuf) FileInfo(name string) os.FileInfo {
+	return &statInfo{name,*s}
+}
+
+type statInfo struct{
+	name string
+	sb Statbuf
+}
+func (i *statInfo) Name() string { return i.name }
+func (i *statInfo) Size() int64 { return i.sb.Size }
+func (i *statInfo) Mode() os.FileMode {
+	m := os.FileMode(i.sb.Mode&0777)
+	if i.sb.IsDir { m |= os.ModeDir }
+	if i.sb.IsSymlink { m |= os.ModeSymlink }
+	return m
+}
+func (i *statInfo) ModTime() time.Time { return i.sb.ModTime }
+func (i *statInfo) IsDir() bool { return i.sb.IsDir }
+func (i *statInfo) Sys() interface{} { return &i.sb }
+
+// A directory entry including the attributes of the child.
+type DirEntry struct {
+	Name string
+	Id   *uuid.UUID
+	Stat Statbuf
+}
+
+// Mode and owner of a new node.
+type NodeAttr struct {
+	// Permission bits (07777).
+	Mode     uint32
+	Uid, Gid uint32
 }
 
 type Facade2 interface{
 	Facade
-	HL_Mkdir (id *uuid.UUID,name string) (*uuid.UUID,error)
-	HL_Mkfile(id *uuid.UUID,name string) (*uuid.UUID,error)
+	// Creates a node id/name. flags is CreateExclusive or CreateOpen.
+	HL_Mkdir (id *uuid.UUID,name string,flags int) (*uuid.UUID,error)
+	HL_Mkfile(id *uuid.UUID,name string,flags int) (*uuid.UUID,error)
+	// Like HL_Mkdir, HL_Mkfile and HL_Symlink, but a new node gets the mode and
+	// owner in attr, before it is linked. An existing node is left as it is.
+	HL_MkdirAttr  (id *uuid.UUID,name string,flags int,attr *NodeAttr) (*uuid.UUID,error)
+	HL_MkfileAttr (id *uuid.UUID,name string,flags int,attr *NodeAttr) (*uuid.UUID,error)
+	HL_SymlinkAttr(id *uuid.UUID,name string,target string,attr *NodeAttr) (*uuid.UUID,error)
 	HL_Stat  (id *uuid.UUID, sb *Statbuf) error
+	// Like Readdir, but with the UUID and attributes of every child.
+	HL_ReadDirPlus(id *uuid.UUID,cookie string,max int) ([]DirEntry,string,error)
 	HL_Delete(id *uuid.UUID,name string) error
+	// Like HL_Delete, but removes directories including their content.
+	HL_DeleteTree(id *uuid.UUID,name string) error
 	HL_ReadAt(id *uuid.UUID, b []byte, off int64) ([]byte,error)
-	HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string) error
+	// Moves oid/oname to nid/nname. flags is 0 (replace an existing target),
+	// RenameNoReplace or RenameExchange. Moving a directory below itself fails
+	// with EINVAL.
+	HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string, flags int) error
+	// Creates a hard link id/name to the existing node target.
+	HL_Link(id *uuid.UUID,name string, target *uuid.UUID) error
+	// Creates a symbolic link id/name pointing to target.
+	HL_Symlink(id *uuid.UUID,name string, target string) (*uuid.UUID,error)
+	HL_Readlink(id *uuid.UUID) (string,error)
+	// Resolves an inode number, as reported by HL_Stat, to its node. This is
+	// best-effort: only nodes, that have been stat'ed or created recently
+	// by this server, are known. Others fail with ENOENT, even if they exist.
+	HL_LookupIno(ino uint64) (*uuid.UUID,error)
+	HL_Chmod(id *uuid.UUID,mode uint32) error
+	// Changes owner and group. A value of ^uint32(0) leaves it unchanged.
+	HL_Chown(id *uuid.UUID,uid, gid uint32) error
 	
 	// RPC-Friendly version of HL_ReadAt
 	HL_ReadAt2(id *uuid.UUID, size int, off int64) ([]byte,error)
@@ -68,41 +178,196 @@ type LL_Facade interface{
 	Stat(id *uuid.UUID) (os.FileInfo, error)
 	Mkfile(id *uuid.UUID) error
 	Mkdir(id *uuid.UUID) error
+	// Creates a symlink node with the given target.
+	Mksymlink(id *uuid.UUID,target string) error
+	Readlink(id *uuid.UUID) (string,error)
+	// Sets the permission bits (07777) of the node.
+	Chmod(id *uuid.UUID,mode uint32) error
+	// Sets owner and group of the node. ^uint32(0) leaves it unchanged.
+	Chown(id *uuid.UUID,uid, gid uint32) error
 	PutDirent(id *uuid.UUID,name string, child *uuid.UUID) error
+	// Like PutDirent, but increments the link count of the child.
+	LinkDirent(id *uuid.UUID,name string, child *uuid.UUID) error
+	// Like PutDirent, but atomically replaces an existing dirent, whose child
+	// is returned (nil, if there was none). Link counts are not changed.
+	SetDirent(id *uuid.UUID,name string, child *uuid.UUID) (*uuid.UUID,error)
 	DelDirent(id *uuid.UUID,name string) error
+	// Removes the dirent and drops the link count of the child. Removes the
+	// child, if it is not linked anymore.
 	DelDirentFull(id *uuid.UUID,name string) error
+	// Removes a node, that is not referenced by any dirent.
+	DelNode(id *uuid.UUID) error
+	// Decrements the link count of a node, that lost a dirent through
+	// SetDirent. Removes the node, once it is not linked anymore.
+	DropLink(id *uuid.UUID) error
 	ReadAt(id *uuid.UUID, b []byte, off int64) (int,error)
 }
+// Flags of HL_Movelink, as in renameat2(2).
+const (
+	// Fails with EEXIST, if the target exists.
+	RenameNoReplace = 1
+	// Swaps source and target, which both must exist.
+	RenameExchange = 2
+)
+
+// Flags of HL_Mkdir and HL_Mkfile.
+const (
+	// Fails with EEXIST, if the name is already taken.
+	CreateExclusive = 0
+	// Returns the existing node, if the name is taken by one of the same type.
+	CreateOpen = 1
+)
+
 type HL_Wrap struct{
 	LL_Facade
+	
+	// If not nil, multi-step operations are logged here, so that Recover()
+	// can complete or roll them back after a crash.
+	Journal Journal
+	
+	// The inode numbers handed out by HL_Stat.
+	Inodes InodeTable
 }
 
-func (h *HL_Wrap) HL_Mkdir (id *uuid.UUID,name string) (*uuid.UUID,error) {
-	nid,e := uuid.NewV4()
-	if e!=nil { return nil,e }
-	e = h.Mkdir(nid)
+// Checks, whether id/name exists. With CreateOpen, an existing node of the
+// right type is returned, otherwise the name being taken is an error.
+func (h *HL_Wrap) existing(id *uuid.UUID,name string,op int,flags int) (*uuid.UUID,error) {
+	cid,e := h.Lookup(id,name)
+	if CodeOf(e)==CodeNoEnt { return nil,nil }
 	if e!=nil { return nil,e }
-	e = h.PutDirent(id,name,nid)
-	if e!=nil { return nil,e }
-	return nid,nil
+	err := &os.PathError{Op:"create",Path:name,Err:syscall.EEXIST}
+	if (flags&CreateOpen)==0 { return nil,err }
+	var sb Statbuf
+	if e = h.HL_Stat(cid,&sb); e!=nil { return nil,e }
+	switch {
+	case op==IntentMkdir && sb.IsDir: return cid,nil
+	case op==IntentMkfile && sb.IsRegular && !sb.IsSymlink: return cid,nil
+	case op==IntentMkfile && sb.IsDir: err.Err = syscall.EISDIR
+	}
+	return nil,err
 }
-func (h *HL_Wrap) HL_Mkfile(id *uuid.UUID,name string) (*uuid.UUID,error) {
+func (h *HL_Wrap) mknode(id *uuid.UUID,name string,op int,flags int,target string,attr *NodeAttr) (*uuid.UUID,error) {
+	// Check first, so that no node is created needlessly.
+	cid,e := h.existing(id,name,op,flags)
+	if cid!=nil || e!=nil { return cid,e }
 	nid,e := uuid.NewV4()
 	if e!=nil { return nil,e }
-	e = h.Mkfile(nid)
-	if e!=nil { return nil,e }
-	e = h.PutDirent(id,name,nid)
+	key,e := h.begin(&Intent{Op:op,Id:id,Name:name,Child:nid})
 	if e!=nil { return nil,e }
+	switch op {
+	case IntentMkdir:
+		e = h.Mkdir(nid)
+	case IntentSymlink:
+		e = h.Mksymlink(nid,target)
+	default:
+		e = h.Mkfile(nid)
+	}
+	if e==nil {
+		if attr!=nil { e = h.Chmod(nid,attr.Mode&07777) }
+		if e==nil && attr!=nil { e = h.Chown(nid,attr.Uid,attr.Gid) }
+		if e==nil { e = h.PutDirent(id,name,nid) }
+		// If the rollback fails, leave it to Recover().
+		if e!=nil && h.DelNode(nid)!=nil { return nil,e }
+	}
+	e = h.done(key,e)
+	if e==nil { h.newInode(nid) }
+	if e!=nil {
+		// Lost a race against another creator.
+		if (flags&CreateOpen)!=0 && CodeOf(e)==CodeExist {
+			if cid,e2 := h.existing(id,name,op,flags); cid!=nil || e2!=nil { return cid,e2 }
+		}
+		return nil,e
+	}
 	return nid,nil
 }
+func (h *HL_Wrap) HL_Mkdir (id *uuid.UUID,name string,flags int) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentMkdir,flags,"",nil)
+}
+func (h *HL_Wrap) HL_Mkfile(id *uuid.UUID,name string,flags int) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentMkfile,flags,"",nil)
+}
+func (h *HL_Wrap) HL_Symlink(id *uuid.UUID,name string, target string) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentSymlink,CreateExclusive,target,nil)
+}
+func (h *HL_Wrap) HL_MkdirAttr (id *uuid.UUID,name string,flags int,attr *NodeAttr) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentMkdir,flags,"",attr)
+}
+func (h *HL_Wrap) HL_MkfileAttr(id *uuid.UUID,name string,flags int,attr *NodeAttr) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentMkfile,flags,"",attr)
+}
+func (h *HL_Wrap) HL_SymlinkAttr(id *uuid.UUID,name string, target string,attr *NodeAttr) (*uuid.UUID,error) {
+	return h.mknode(id,name,IntentSymlink,CreateExclusive,target,attr)
+}
+func (h *HL_Wrap) HL_Readlink(id *uuid.UUID) (string,error) {
+	return h.Readlink(id)
+}
 func (h *HL_Wrap) HL_Stat(id *uuid.UUID, sb *Statbuf) error {
 	s,e := h.Stat(id)
 	if e!=nil { return e }
 	sb.FromFileInfo(s)
+	h.inode(id,sb)
 	return nil
 }
+// Dirents, that can't be resolved, are left out.
+func (h *HL_Wrap) HL_ReadDirPlus(id *uuid.UUID,cookie string,max int) ([]DirEntry,string,error) {
+	names,next,e := h.Readdir(id,cookie,max)
+	if e!=nil { return nil,"",e }
+	ents := make([]DirEntry,0,len(names))
+	for _,name := range names {
+		cid,e := h.Lookup(id,name)
+		if e!=nil { continue }
+		ent := DirEntry{Name:name,Id:cid}
+		if h.HL_Stat(cid,&ent.Stat)!=nil { continue }
+		ents = append(ents,ent)
+	}
+	return ents,next,nil
+}
 func (h *HL_Wrap) HL_Delete(id *uuid.UUID,name string) error {
-	return h.DelDirentFull(id,name)
+	cid,_ := h.Lookup(id,name)
+	e := h.DelDirentFull(id,name)
+	if e==nil && cid!=nil { h.release(cid) }
+	return e
+}
+func (h *HL_Wrap) deleteTree(id *uuid.UUID,name string,seen map[uuid.UUID]bool) error {
+	cid,e := h.Lookup(id,name)
+	if e!=nil { return e }
+	if s,e := h.Stat(cid); e==nil && s.IsDir() {
+		// A directory seen twice is a cycle. Hard links to other nodes are
+		// dropped one by one, to keep their link count right.
+		if seen[*cid] { return h.DelDirent(id,name) }
+		seen[*cid] = true
+		names,e := h.Readdirnames(cid)
+		if e!=nil { return e }
+		for _,cname := range names {
+			e = h.deleteTree(cid,cname,seen)
+			if e!=nil { return e }
+		}
+	}
+	e = h.DelDirentFull(id,name)
+	if e==nil { h.release(cid) }
+	return e
+}
+func (h *HL_Wrap) HL_DeleteTree(id *uuid.UUID,name string) error {
+	return h.deleteTree(id,name,make(map[uuid.UUID]bool))
+}
+// The link count is raised before the dirent is added, so the old count is
+// journaled, to restore it, if the dirent never made it.
+func (h *HL_Wrap) HL_Link(id *uuid.UUID,name string, target *uuid.UUID) error {
+	in := &Intent{Op:IntentLink,Id:id,Name:name,Child:target}
+	if h.Journal!=nil {
+		var sb Statbuf
+		if e := h.HL_Stat(target,&sb); e!=nil { return e }
+		in.Nlink = sb.Nlink
+	}
+	key,e := h.begin(in)
+	if e!=nil { return e }
+	return h.done(key,h.LinkDirent(id,name,target))
+}
+func (h *HL_Wrap) HL_Chmod(id *uuid.UUID,mode uint32) error {
+	return h.Chmod(id,mode)
+}
+func (h *HL_Wrap) HL_Chown(id *uuid.UUID,uid, gid uint32) error {
+	return h.Chown(id,uid,gid)
 }
 func (h *HL_Wrap) HL_ReadAt(id *uuid.UUID, b []byte, off int64) ([]byte,error) {
 	n,e := h.ReadAt(id,b,off)
@@ -113,15 +378,112 @@ func (h *HL_Wrap) HL_ReadAt2(id *uuid.UUID, size int, off int64) ([]byte,error)
 	n,e := h.ReadAt(id,b,off)
 	return b[:n],e
 }
-func (h *HL_Wrap) HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string) error {
+func (h *HL_Wrap) HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string, flags int) error {
 	id,e := h.Lookup(oid,oname)
 	if e!=nil { return e }
-	e = h.PutDirent(nid,nname,id)
-	if e!=nil { return e }
-	e = h.DelDirent(oid,oname)
+	if (flags&RenameNoReplace)!=0 && (flags&RenameExchange)!=0 {
+		return &os.LinkError{Op:"rename",Old:oname,New:nname,Err:syscall.EINVAL}
+	}
+	old,e := h.Lookup(nid,nname)
 	if e!=nil {
-		h.DelDirent(nid,nname)
+		if (flags&RenameExchange)!=0 { return e }
+		if CodeOf(e)!=CodeNoEnt { return e }
+		old = nil
+	}
+	if old!=nil && *old==*id { return nil } // Both are links to the same node.
+	if *oid!=*nid {
+		if e = h.notBelow(id,nid); e!=nil { return e }
+		if old!=nil && (flags&RenameExchange)!=0 {
+			if e = h.notBelow(old,oid); e!=nil { return e }
+		}
+	}
+	if (flags&RenameExchange)!=0 { return h.exchange(oid,oname,id,nid,nname,old) }
+	if old!=nil {
+		if (flags&RenameNoReplace)!=0 {
+			return &os.LinkError{Op:"rename",Old:oname,New:nname,Err:syscall.EEXIST}
+		}
+		if e = h.replaceable(id,old); e!=nil { return e }
+	}
+	key,e := h.begin(&Intent{Op:IntentMovelink,Id:oid,Name:oname,Child:id,Nid:nid,Nname:nname})
+	if e!=nil { return e }
+	if old==nil {
+		e = h.PutDirent(nid,nname,id)
+	}else{
+		old,e = h.SetDirent(nid,nname,id)
+	}
+	if e==nil {
+		e = h.DelDirent(oid,oname)
+		if e!=nil {
+			// Roll back. If that fails, leave it to Recover().
+			var e2 error
+			if old==nil {
+				e2 = h.DelDirent(nid,nname)
+			}else{
+				_,e2 = h.SetDirent(nid,nname,old)
+			}
+			if e2!=nil { return e }
+		}
+	}
+	e = h.done(key,e)
+	if e==nil && old!=nil {
+		// A crash before this leaves an orphan behind, that the GC removes.
+		e = h.DropLink(old)
+		h.release(old)
 	}
 	return e
 }
+// Checks, that the directory dir is neither the node id nor below it, as a
+// directory can not be moved into its own subtree. Dirents have no links to
+// their parents, so the subtree of id is searched for dir.
+func (h *HL_Wrap) notBelow(id, dir *uuid.UUID) error {
+	err := &os.PathError{Op:"rename",Path:id.String(),Err:syscall.EINVAL}
+	if *id==*dir { return err }
+	if s,e := h.Stat(id); e!=nil || !s.IsDir() { return e }
+	seen := map[uuid.UUID]bool{*id:true}
+	queue := []*uuid.UUID{id}
+	for len(queue)>0 {
+		cur := queue[0]
+		queue = queue[1:]
+		names,e := h.Readdirnames(cur)
+		if e!=nil { return e }
+		for _,name := range names {
+			cid,e := h.Lookup(cur,name)
+			if e!=nil || seen[*cid] { continue }
+			if *cid==*dir { return err }
+			seen[*cid] = true
+			if s,e := h.Stat(cid); e==nil && s.IsDir() { queue = append(queue,cid) }
+		}
+	}
+	return nil
+}
+// Checks, whether the node old may be replaced by id, as in rename(2).
+func (h *HL_Wrap) replaceable(id, old *uuid.UUID) error {
+	var sb,osb Statbuf
+	if e := h.HL_Stat(id,&sb); e!=nil { return e }
+	if e := h.HL_Stat(old,&osb); e!=nil { return e }
+	err := &os.PathError{Op:"rename",Path:old.String()}
+	switch {
+	case sb.IsDir && !osb.IsDir: err.Err = syscall.ENOTDIR
+	case !sb.IsDir && osb.IsDir: err.Err = syscall.EISDIR
+	case osb.IsDir:
+		names,_,e := h.Readdir(old,"",1)
+		if e!=nil { return e }
+		if len(names)==0 { return nil }
+		err.Err = syscall.ENOTEMPTY
+	default: return nil
+	}
+	return err
+}
+func (h *HL_Wrap) exchange(oid *uuid.UUID, oname string, id, nid *uuid.UUID, nname string, other *uuid.UUID) error {
+	key,e := h.begin(&Intent{Op:IntentExchange,Id:oid,Name:oname,Child:id,Nid:nid,Nname:nname,Other:other})
+	if e!=nil { return e }
+	_,e = h.SetDirent(nid,nname,id)
+	if e==nil {
+		_,e = h.SetDirent(oid,oname,other)
+		if e!=nil {
+			if _,e2 := h.SetDirent(nid,nname,other); e2!=nil { return e }
+		}
+	}
+	return h.done(key,e)
+}
 
@@ -0,0 +1,63 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "errors"
+import "syscall"
+import "testing"
+
+// A directory can not be moved into itself, or below itself.
+func TestMovelinkIntoSubtree(t *testing.T) {
+	m := new(MemFileSystem).Init()
+	root := uuid.NamespaceURL
+	m.Mkdir(root)
+	h := &HL_Wrap{LL_Facade:m}
+	a,e := h.HL_Mkdir(root,"a",0)
+	if e!=nil { t.Fatal(e) }
+	b,_ := h.HL_Mkdir(a,"b",0)
+	c,_ := h.HL_Mkdir(b,"c",0)
+	h.HL_Mkfile(c,"f",0)
+	
+	for _,dir := range []*uuid.UUID{a,b,c} {
+		if e := h.HL_Movelink(root,"a",dir,"a",0); !errors.Is(e,syscall.EINVAL) { t.Fatal(dir,e) }
+	}
+	if e := h.HL_Movelink(a,"b",c,"b",RenameNoReplace); !errors.Is(e,syscall.EINVAL) { t.Fatal(e) }
+	
+	// Exchanging a with c would move a below c as well.
+	if e := h.HL_Movelink(b,"c",root,"a",RenameExchange); !errors.Is(e,syscall.EINVAL) { t.Fatal(e) }
+	if e := h.HL_Movelink(root,"a",b,"c",RenameExchange); !errors.Is(e,syscall.EINVAL) { t.Fatal(e) }
+	
+	// Nothing has changed.
+	if id,e := h.Lookup(root,"a"); e!=nil || *id!=*a { t.Fatal(id,e) }
+	if id,e := h.Lookup(b,"c"); e!=nil || *id!=*c { t.Fatal(id,e) }
+	if names,_ := h.Readdirnames(c); len(names)!=1 { t.Fatal(names) }
+	
+	// Moving it out of its subtree, or a file into it, is fine.
+	if e := h.HL_Movelink(b,"c",root,"c",0); e!=nil { t.Fatal(e) }
+	if e := h.HL_Movelink(c,"f",b,"f",0); e!=nil { t.Fatal(e) }
+	if e := h.HL_Movelink(root,"c",a,"c",0); e!=nil { t.Fatal(e) }
+}
@@ -0,0 +1,143 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "github.com/hashicorp/golang-lru/simplelru"
+import "encoding/binary"
+import "os"
+import "strconv"
+import "sync"
+import "syscall"
+
+// Folds a node UUID into a 64 bit inode number. The result is never 0.
+func InodeOf(id *uuid.UUID) uint64 {
+	i := binary.BigEndian.Uint64(id[:8])^binary.BigEndian.Uint64(id[8:])
+	if i==0 { i = 1 }
+	return i
+}
+
+// Implemented by backends, that can store an inode number, which has been
+// assigned to a node because of a collision. Stat reports it in Statbuf.Ino,
+// unstored nodes have Ino 0.
+type InoSetter interface{
+	SetIno(id *uuid.UUID,ino uint64) error
+}
+
+// Number of nodes an InodeTable keeps, if Max is not set.
+const DefaultInodeTableSize = 1<<20
+
+// Maps the inode numbers, that have been handed out, back to their nodes.
+// Deleted nodes are forgotten, and so are the least recently used ones, once
+// the table holds Max nodes. Collisions are only detected among the nodes in
+// the table. The zero value is ready to use.
+type InodeTable struct {
+	// Zero means DefaultInodeTableSize.
+	Max int
+	
+	lock  sync.Mutex
+	nodes map[uint64]uuid.UUID
+	inos  *simplelru.LRU // uuid.UUID -> uint64
+}
+func (t *InodeTable) init() {
+	if t.inos!=nil { return }
+	max := t.Max
+	if max<=0 { max = DefaultInodeTableSize }
+	t.nodes = make(map[uint64]uuid.UUID)
+	t.inos,_ = simplelru.NewLRU(max,func(key,value interface{}) {
+		delete(t.nodes,value.(uint64))
+	})
+}
+
+// Returns the inode number of the node, with ino as the preferred number.
+// If it is taken by another node, the next free one is used, and fresh
+// is true.
+func (t *InodeTable) Claim(id *uuid.UUID,ino uint64) (n uint64,fresh bool) {
+	t.lock.Lock(); defer t.lock.Unlock()
+	t.init()
+	for n = ino; ; n++ {
+		if n==0 { continue }
+		o,ok := t.nodes[n]
+		if ok && o==*id {
+			t.inos.Get(*id)
+			return n,n!=ino
+		}
+		if ok { continue }
+		if old,ok := t.inos.Peek(*id); ok { delete(t.nodes,old.(uint64)) }
+		t.nodes[n] = *id
+		t.inos.Add(*id,n)
+		return n,n!=ino
+	}
+}
+// Removes the node from the table.
+func (t *InodeTable) Forget(id *uuid.UUID) {
+	t.lock.Lock(); defer t.lock.Unlock()
+	if t.inos!=nil { t.inos.Remove(*id) }
+}
+func (t *InodeTable) Lookup(ino uint64) (*uuid.UUID,bool) {
+	t.lock.Lock(); defer t.lock.Unlock()
+	id,ok := t.nodes[ino]
+	if ok { t.inos.Get(id) }
+	return &id,ok
+}
+
+// Assigns the inode number of a node, and stores it, if it differs from the
+// folded UUID.
+func (h *HL_Wrap) inode(id *uuid.UUID,sb *Statbuf) {
+	ino := sb.Ino
+	if ino==0 { ino = InodeOf(id) }
+	n,fresh := h.Inodes.Claim(id,ino)
+	if fresh {
+		if s,ok := h.LL_Facade.(InoSetter); ok { s.SetIno(id,n) }
+	}
+	sb.Ino = n
+}
+// Assigns the inode number of a new node. It is always stored, so that it
+// survives a restart, even if a colliding node is stat'ed first then.
+func (h *HL_Wrap) newInode(id *uuid.UUID) {
+	s,ok := h.LL_Facade.(InoSetter)
+	if !ok { return }
+	n,_ := h.Inodes.Claim(id,InodeOf(id))
+	s.SetIno(id,n)
+}
+// Forgets the inode number of a node, once it has been removed.
+func (h *HL_Wrap) release(id *uuid.UUID) {
+	if _,e := h.Stat(id); CodeOf(e)==CodeNoEnt { h.Inodes.Forget(id) }
+}
+
+// Resolves an inode number, that has been reported by HL_Stat, back to its
+// node. The table is neither persisted nor complete (see InodeTable), so only
+// nodes, that have been stat'ed or created recently, are known; others are
+// reported as not existing.
+func (h *HL_Wrap) HL_LookupIno(ino uint64) (*uuid.UUID,error) {
+	id,ok := h.Inodes.Lookup(ino)
+	if !ok { return nil,&os.PathError{Op:"lookupino",Path:"#"+strconv.FormatUint(ino,10),Err:syscall.ENOENT} }
+	return id,nil
+}
+
+func (fs *FileSystem) SetIno(id *uuid.UUID,ino uint64) error {
+	return setMetaUint(fs.extrude(id),"ino",ino)
+}
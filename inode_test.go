@@ -0,0 +1,51 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "testing"
+
+func TestInodeTable(t *testing.T) {
+	tab := &InodeTable{Max:2}
+	var ids []*uuid.UUID
+	for i := 0; i<3; i++ {
+		id,_ := uuid.NewV4()
+		ids = append(ids,id)
+	}
+	a,_ := tab.Claim(ids[0],5)
+	b,fresh := tab.Claim(ids[1],5)
+	if a!=5 || b!=6 || !fresh { t.Fatal(a,b,fresh) }
+	
+	// The least recently used node is dropped.
+	tab.Lookup(5)
+	tab.Claim(ids[2],7)
+	if _,ok := tab.Lookup(6); ok { t.Fatal("not dropped") }
+	if id,ok := tab.Lookup(5); !ok || *id!=*ids[0] { t.Fatal(id,ok) }
+	if n,_ := tab.Claim(ids[1],6); n!=6 { t.Fatal(n) }
+	
+	tab.Forget(ids[1])
+	if _,ok := tab.Lookup(6); ok { t.Fatal("not forgotten") }
+}
@@ -0,0 +1,226 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "encoding/gob"
+import "os"
+import "path/filepath"
+import "strings"
+
+// Kinds of multi-step operations, recorded in a Journal.
+const (
+	IntentMkdir = iota+1
+	IntentMkfile
+	IntentMovelink
+	IntentSymlink
+	IntentExchange
+	IntentLink
+)
+
+// An operation, that has been started but not necessarily completed.
+//
+// For IntentMkdir, IntentMkfile and IntentSymlink, Child is the new node and Id/Name is
+// the dirent, that should point to it.
+// For IntentMovelink, Child is moved from Id/Name to Nid/Nname.
+// For IntentExchange, Child at Id/Name and Other at Nid/Nname swap places.
+// For IntentLink, Id/Name becomes a hard link to Child, whose link count was
+// Nlink before.
+type Intent struct {
+	Op    int
+	Id    *uuid.UUID
+	Name  string
+	Child *uuid.UUID
+	Nid   *uuid.UUID
+	Nname string
+	Other *uuid.UUID
+	Nlink uint32
+}
+
+// A write-ahead log of intents. Log must not return before the intent is
+// durable.
+type Journal interface{
+	Log(in *Intent) (key string,err error)
+	Done(key string) error
+	Pending() (map[string]*Intent,error)
+}
+
+// A Journal, that stores each intent as a file in the directory Path.
+type DirJournal struct {
+	Path string
+}
+
+// Returns a Journal located in the backing store.
+func (fs *FileSystem) Journal() *DirJournal {
+	return &DirJournal{fs.Prefix+".journal"}
+}
+
+// Implemented by backends, that keep temporary files during operations,
+// which a crash leaves behind.
+type TempCleaner interface{
+	CleanTemp() error
+}
+
+// Removes the temporary symlinks of SetDirent and MigrateDirents. The store
+// must not be in use.
+func (fs *FileSystem) CleanTemp() error {
+	d,e := os.Open(fs.Prefix)
+	if e!=nil { return e }
+	names,e := d.Readdirnames(0)
+	d.Close()
+	if e!=nil { return e }
+	for _,name := range names {
+		if !strings.HasPrefix(name,renamePrefix) { continue }
+		if e = os.Remove(fs.Prefix+name); e!=nil && !os.IsNotExist(e) { return e }
+	}
+	return nil
+}
+
+func syncDir(path string) error {
+	d,e := os.Open(path)
+	if e!=nil { return e }
+	defer d.Close()
+	return d.Sync()
+}
+func (j *DirJournal) Log(in *Intent) (string,error) {
+	id,e := uuid.NewV4()
+	if e!=nil { return "",e }
+	key := id.String()
+	e = os.MkdirAll(j.Path,0700)
+	if e!=nil { return "",e }
+	tmp := filepath.Join(j.Path,key+".tmp")
+	f,e := os.OpenFile(tmp,os.O_CREATE|os.O_EXCL|os.O_WRONLY,0600)
+	if e!=nil { return "",e }
+	e = gob.NewEncoder(f).Encode(in)
+	if e==nil { e = f.Sync() }
+	f.Close()
+	if e==nil { e = os.Rename(tmp,filepath.Join(j.Path,key)) }
+	if e==nil { e = syncDir(j.Path) }
+	if e!=nil {
+		os.Remove(tmp)
+		return "",e
+	}
+	return key,nil
+}
+func (j *DirJournal) Done(key string) error {
+	return os.Remove(filepath.Join(j.Path,key))
+}
+func (j *DirJournal) Pending() (map[string]*Intent,error) {
+	d,e := os.Open(j.Path)
+	if os.IsNotExist(e) { return nil,nil }
+	if e!=nil { return nil,e }
+	names,e := d.Readdirnames(0)
+	d.Close()
+	if e!=nil { return nil,e }
+	m := make(map[string]*Intent)
+	for _,name := range names {
+		fn := filepath.Join(j.Path,name)
+		if strings.HasSuffix(name,".tmp") {
+			// Never became durable, so the operation was not started.
+			os.Remove(fn)
+			continue
+		}
+		f,e := os.Open(fn)
+		if e!=nil { return nil,e }
+		in := new(Intent)
+		e = gob.NewDecoder(f).Decode(in)
+		f.Close()
+		if e!=nil { return nil,e }
+		m[name] = in
+	}
+	return m,nil
+}
+
+func (h *HL_Wrap) begin(in *Intent) (string,error) {
+	if h.Journal==nil { return "",nil }
+	return h.Journal.Log(in)
+}
+// Completes an intent. err is the result of the operation, which takes
+// precedence.
+func (h *HL_Wrap) done(key string,err error) error {
+	if h.Journal==nil { return err }
+	e := h.Journal.Done(key)
+	if err!=nil { return err }
+	return e
+}
+
+// Completes or rolls back every operation left incomplete in the Journal.
+// Node creations are rolled back, unless the dirent already exists.
+// Moves are completed, if the new dirent exists, otherwise rolled back. A
+// node replaced by a move may be left unlinked; the GC removes it.
+// Exchanges are completed, once the first dirent has been swapped.
+// Hard links, whose dirent is missing, have their link count restored.
+// Temporary files of the backend (see TempCleaner) are removed.
+//
+// Call this before the facade is being used.
+func (h *HL_Wrap) Recover() error {
+	if c,ok := h.LL_Facade.(TempCleaner); ok {
+		if e := c.CleanTemp(); e!=nil { return e }
+	}
+	if h.Journal==nil { return nil }
+	p,e := h.Journal.Pending()
+	if e!=nil { return e }
+	for key,in := range p {
+		switch in.Op {
+		case IntentMkdir,IntentMkfile,IntentSymlink:
+			if c,e := h.Lookup(in.Id,in.Name); e==nil && *c==*in.Child { break }
+			if _,e = h.Stat(in.Child); e==nil {
+				e = h.DelNode(in.Child)
+			}else if os.IsNotExist(e) {
+				e = nil
+			}
+		case IntentMovelink:
+			o,eo := h.Lookup(in.Id,in.Name)
+			n,en := h.Lookup(in.Nid,in.Nname)
+			ook := eo==nil && *o==*in.Child
+			nok := en==nil && *n==*in.Child
+			e = nil
+			if ook && nok {
+				e = h.DelDirent(in.Id,in.Name)
+			}else if !ook && !nok {
+				e = h.PutDirent(in.Id,in.Name,in.Child)
+			}
+		case IntentExchange:
+			o,eo := h.Lookup(in.Id,in.Name)
+			n,en := h.Lookup(in.Nid,in.Nname)
+			e = nil
+			if eo==nil && en==nil && *o==*in.Child && *n==*in.Child {
+				_,e = h.SetDirent(in.Id,in.Name,in.Other)
+			}
+		case IntentLink:
+			if c,e := h.Lookup(in.Id,in.Name); e==nil && *c==*in.Child { break }
+			var sb Statbuf
+			e = h.HL_Stat(in.Child,&sb)
+			if os.IsNotExist(e) { e = nil; break }
+			if e==nil && sb.Nlink>in.Nlink { e = h.DropLink(in.Child) }
+		}
+		if e!=nil { return e }
+		e = h.Journal.Done(key)
+		if e!=nil { return e }
+	}
+	return nil
+}
+
@@ -0,0 +1,90 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "os"
+import "testing"
+
+func journaled(t *testing.T,dir string) (*HL_Wrap,*DirJournal) {
+	fs := &FileSystem{Prefix:dir}
+	h := &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16),Journal:fs.Journal()}
+	if e := h.Mkdir(uuid.NamespaceURL); e!=nil { t.Fatal(e) }
+	return h,h.Journal.(*DirJournal)
+}
+
+// Operations cut short by a crash are completed or rolled back.
+func TestRecover(t *testing.T) {
+	dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	h,j := journaled(t,dir)
+	root := uuid.NamespaceURL
+	a,e := h.HL_Mkdir(root,"a",0)
+	if e!=nil { t.Fatal(e) }
+	
+	// A node, that never got its dirent.
+	orphan,_ := uuid.NewV4()
+	h.Mkfile(orphan)
+	j.Log(&Intent{Op:IntentMkfile,Id:root,Name:"x",Child:orphan})
+	
+	// A move, that got the new dirent, but kept the old one.
+	f,_ := h.HL_Mkfile(a,"f",0)
+	h.PutDirent(root,"g",f)
+	j.Log(&Intent{Op:IntentMovelink,Id:a,Name:"f",Child:f,Nid:root,Nname:"g"})
+	
+	// A move, that got neither.
+	m,_ := h.HL_Mkfile(a,"m",0)
+	h.DelDirent(a,"m")
+	j.Log(&Intent{Op:IntentMovelink,Id:a,Name:"m",Child:m,Nid:root,Nname:"m"})
+	
+	// A hard link, whose count was raised, but the dirent never added.
+	l,_ := h.HL_Mkfile(root,"l",0)
+	h.LinkDirent(root,"l2",l)
+	h.DelDirent(root,"l2")
+	j.Log(&Intent{Op:IntentLink,Id:root,Name:"l2",Child:l,Nlink:1})
+	
+	if e := h.Recover(); e!=nil { t.Fatal(e) }
+	if _,e := h.Stat(orphan); !os.IsNotExist(e) { t.Error("orphan kept",e) }
+	if _,e := h.Lookup(a,"f"); e==nil { t.Error("move not completed") }
+	if id,e := h.Lookup(root,"g"); e!=nil || *id!=*f { t.Error("move not completed",e) }
+	if id,e := h.Lookup(a,"m"); e!=nil || *id!=*m { t.Error("move not rolled back",e) }
+	var sb Statbuf
+	if e := h.HL_Stat(l,&sb); e!=nil || sb.Nlink!=1 { t.Error("link count",sb.Nlink,e) }
+	if p,e := j.Pending(); e!=nil || len(p)!=0 { t.Error(p,e) }
+}
+
+// A failed creation leaves neither a node nor an intent behind.
+func TestJournalRollback(t *testing.T) {
+	dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	h,j := journaled(t,dir)
+	root := uuid.NamespaceURL
+	if _,e := h.HL_Mkdir(root,"a",0); e!=nil { t.Fatal(e) }
+	if _,e := h.HL_Mkfile(root,"a",0); !os.IsExist(e) { t.Fatal(e) }
+	ents,_ := os.ReadDir(dir)
+	if len(ents)!=4 { t.Error(len(ents)) } // root, a, .journal and .layout
+	if p,e := j.Pending(); e!=nil || len(p)!=0 { t.Error(p,e) }
+}
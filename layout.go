@@ -0,0 +1,224 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+// The highest number of fan-out levels. Each level consumes two hex digits of
+// the first UUID group.
+const MaxLevels = 4
+
+// Name of the layout marker file within the backing store.
+const LayoutFile = ".layout"
+
+var ErrConverting = errors.New("quickfs: layout conversion in progress")
+
+// Returned, when nodes are to be created, but the layout of the *FileSystem
+// does not match the one of the backing store. LoadLayout has not been called
+// then, and the layout can only be changed by Convert.
+var ErrLayoutMismatch = errors.New("quickfs: layout does not match the backing store")
+
+var errFound = errors.New("found")
+
+func shard(ids string,levels int) string {
+	s := ""
+	for i := 0; i<levels; i++ {
+		s += ids[2*i:2*i+2]+"/"
+	}
+	return s
+}
+func isShard(name string) bool {
+	if len(name)!=2 { return false }
+	for _,c := range []byte(name) {
+		if !(('0'<=c && c<='9') || ('a'<=c && c<='f')) { return false }
+	}
+	return true
+}
+
+// Reads the layout marker of the backing store and sets fs.Levels. A store
+// without marker uses the flat layout, it is marked when the first node is
+// created. If the marker records an unfinished
+// conversion, lookups fall back to the old layout until Convert is re-run.
+func (fs *FileSystem) LoadLayout() error {
+	levels,old,e := fs.readLayout()
+	if os.IsNotExist(e) { return nil }
+	if e!=nil { return e }
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	fs.Levels = levels
+	fs.converting = old>=0
+	if fs.converting { fs.oldLevels = old }
+	return nil
+}
+// Returns the levels recorded in the marker, and the old ones, if a
+// conversion is unfinished, -1 otherwise.
+func (fs *FileSystem) readLayout() (levels,old int,e error) {
+	b,e := ioutil.ReadFile(fs.Prefix+LayoutFile)
+	if e!=nil { return 0,-1,e }
+	levels,old = 0,-1
+	n,_ := fmt.Sscanf(string(b),"levels %d\nfrom %d\n",&levels,&old)
+	if n<1 || levels<0 || levels>MaxLevels || old>MaxLevels {
+		return 0,-1,fmt.Errorf("quickfs: bad layout marker %q",b)
+	}
+	return levels,old,nil
+}
+func (fs *FileSystem) saveLayout() error {
+	fs.lock.RLock()
+	s := fmt.Sprintf("levels %d\n",fs.Levels)
+	if fs.converting { s += fmt.Sprintf("from %d\n",fs.oldLevels) }
+	fs.lock.RUnlock()
+	tmp := fs.Prefix+LayoutFile+".tmp"
+	f,e := os.Create(tmp)
+	if e!=nil { return e }
+	_,e = f.WriteString(s)
+	if e==nil { e = f.Sync() }
+	f.Close()
+	if e==nil { e = os.Rename(tmp,fs.Prefix+LayoutFile) }
+	if e!=nil { return e }
+	return syncDir(fs.Prefix)
+}
+
+// Checks the layout against the marker, before the first node is created. A
+// store without marker and nodes is marked with the layout, so tools calling
+// LoadLayout don't mistake it. One with nodes is flat, and marked as such.
+func (fs *FileSystem) checkLayout() error {
+	fs.markLock.Lock(); defer fs.markLock.Unlock()
+	if fs.marked { return nil }
+	fs.lock.RLock()
+	levels,old := fs.Levels,-1
+	if fs.converting { old = fs.oldLevels }
+	fs.lock.RUnlock()
+	mlevels,mold,e := fs.readLayout()
+	if os.IsNotExist(e) {
+		e = fs.walkNodes("",0,func(id *uuid.UUID,path string) error { return errFound },nil)
+		if e==errFound {
+			if levels!=0 || old>=0 { return ErrLayoutMismatch }
+			e = nil
+		}
+		if e==nil { e = fs.saveLayout() }
+	}else if e==nil && (mlevels!=levels || mold!=old) {
+		return ErrLayoutMismatch
+	}
+	if e!=nil { return e }
+	fs.marked = true
+	return nil
+}
+
+// Calls fn for every node in the backing store, with the path of the node.
+// bad is called for entries, that are neither nodes nor fan-out directories.
+// Entries, whose names start with a dot, are reserved for metadata (such as
+// the journal) and skipped.
+func (fs *FileSystem) walkNodes(dir string,depth int,fn func(id *uuid.UUID,path string) error,bad func(path string)) error {
+	d,e := os.Open(fs.Prefix+dir)
+	if e!=nil { return e }
+	defer d.Close()
+	for {
+		names,e := d.Readdirnames(1024)
+		for _,name := range names {
+			if strings.HasPrefix(name,".") { continue }
+			if depth<MaxLevels && isShard(name) {
+				e2 := fs.walkNodes(dir+name+"/",depth+1,fn,bad)
+				if e2!=nil { return e2 }
+				continue
+			}
+			id,e2 := uuid.ParseHex(name)
+			if e2!=nil || id.String()!=name {
+				if bad!=nil { bad(dir+name) }
+				continue
+			}
+			if e2 = fn(id,fs.Prefix+dir+name); e2!=nil { return e2 }
+		}
+		if e==io.EOF { break }
+		if e!=nil { return e }
+	}
+	return nil
+}
+
+// Calls fn for every node in the backing store, regardless of the layout.
+func (fs *FileSystem) WalkNodes(fn func(id *uuid.UUID) error) error {
+	return fs.walkNodes("",0,func(id *uuid.UUID,path string) error { return fn(id) },nil)
+}
+
+// Converts the backing store to the given number of fan-out levels, and
+// records it in the layout marker. This is the only way to change the layout
+// of a store. Nodes are moved one by one. Other users of the same *FileSystem
+// may continue to access the store, while this is running, but no other
+// process may. If the conversion is interrupted, LoadLayout and Convert
+// resume it.
+func (fs *FileSystem) Convert(levels int) error {
+	if levels<0 || levels>MaxLevels { return fmt.Errorf("quickfs: bad number of levels: %d",levels) }
+	if e := fs.checkLayout(); e!=nil { return e }
+	fs.lock.Lock()
+	if fs.converting && fs.Levels!=levels {
+		fs.lock.Unlock()
+		return ErrConverting
+	}
+	if !fs.converting {
+		fs.oldLevels = fs.Levels
+		fs.Levels = levels
+		fs.converting = true
+	}
+	fs.lock.Unlock()
+	
+	e := fs.saveLayout()
+	if e!=nil { return e }
+	e = fs.walkNodes("",0,func(id *uuid.UUID,path string) error {
+		ids := id.String()
+		d := fs.Prefix+shard(ids,levels)
+		if path==d+ids { return nil }
+		if e := os.MkdirAll(d,0700); e!=nil { return e }
+		return moveNode(path,d+ids)
+	},nil)
+	if e!=nil { return e }
+	
+	fs.lock.Lock()
+	fs.converting = false
+	fs.lock.Unlock()
+	e = fs.saveLayout()
+	if e!=nil { return e }
+	fs.removeEmptyShards("",0)
+	return nil
+}
+func (fs *FileSystem) removeEmptyShards(dir string,depth int) {
+	if depth>=MaxLevels { return }
+	names,e := ioutil.ReadDir(fs.Prefix+dir)
+	if e!=nil { return }
+	for _,fi := range names {
+		if !fi.IsDir() || !isShard(fi.Name()) { continue }
+		sub := dir+fi.Name()+"/"
+		fs.removeEmptyShards(sub,depth+1)
+		fs.shards.Lock()
+		os.Remove(filepath.Clean(fs.Prefix+sub))
+		fs.shards.Unlock()
+	}
+}
+
@@ -0,0 +1,117 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sync"
+import "testing"
+
+func tempStore(t *testing.T) string {
+	dir,e := ioutil.TempDir("","quickfs")
+	if e!=nil { t.Fatal(e) }
+	return dir+"/"
+}
+
+// A store must not be used with another layout, than the one it has.
+func TestLayoutMismatch(t *testing.T) {
+	dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	root := uuid.NamespaceURL
+	
+	// An unmarked flat store, as written by older versions.
+	if e := os.Mkdir(dir+root.String(),0700); e!=nil { t.Fatal(e) }
+	fs := &FileSystem{Prefix:dir,Levels:2}
+	if e := fs.Mkdir(root); e!=ErrLayoutMismatch { t.Fatal(e) }
+	if _,e := os.Lstat(dir+LayoutFile); !os.IsNotExist(e) { t.Fatal("marker written",e) }
+	
+	// The flat layout is recorded, when it is first used.
+	fs = &FileSystem{Prefix:dir}
+	h := &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	if _,e := h.HL_Mkdir(root,"a",CreateExclusive); e!=nil { t.Fatal(e) }
+	fs = &FileSystem{Prefix:dir,Levels:2}
+	h = &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	if _,e := h.HL_Mkdir(root,"b",CreateExclusive); e!=ErrLayoutMismatch { t.Fatal(e) }
+	
+	// Only Convert changes the layout.
+	fs = &FileSystem{Prefix:dir}
+	if e := fs.LoadLayout(); e!=nil { t.Fatal(e) }
+	if e := fs.Convert(2); e!=nil { t.Fatal(e) }
+	fs = &FileSystem{Prefix:dir}
+	if e := fs.Mkdir(root); e!=ErrLayoutMismatch { t.Fatal(e) }
+	if e := fs.LoadLayout(); e!=nil { t.Fatal(e) }
+	h = &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	if _,e := h.Lookup(root,"a"); e!=nil { t.Fatal(e) }
+	if _,e := h.HL_Mkdir(root,"b",CreateExclusive); e!=nil { t.Fatal(e) }
+}
+
+// Converts a store back and forth, while nodes are created in it.
+func TestConvertConcurrent(t *testing.T) {
+	dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	fs := &FileSystem{Prefix:dir}
+	root := uuid.NamespaceURL
+	if e := fs.Mkdir(root); e!=nil { t.Fatal(e) }
+	h := &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	
+	const workers = 4
+	const files = 200
+	var wg sync.WaitGroup
+	errs := make(chan error,workers)
+	for w := 0; w<workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i<files; i++ {
+				if _,e := h.HL_Mkfile(root,fmt.Sprint(w,"-",i),CreateExclusive); e!=nil {
+					errs <- e
+					return
+				}
+			}
+		}(w)
+	}
+	for _,levels := range []int{2,1,0,2} {
+		if e := fs.Convert(levels); e!=nil { t.Fatal(e) }
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs { t.Fatal(e) }
+	
+	fs = &FileSystem{Prefix:dir}
+	if e := fs.LoadLayout(); e!=nil { t.Fatal(e) }
+	if fs.Levels!=2 { t.Fatal(fs.Levels) }
+	h = &HL_Wrap{LL_Facade:new(CachedFileSystem).Init(fs,16)}
+	names,e := h.Readdirnames(root)
+	if e!=nil { t.Fatal(e) }
+	if len(names)!=workers*files { t.Fatal(len(names)) }
+	for _,name := range names {
+		id,e := h.Lookup(root,name)
+		if e!=nil { t.Fatal(e) }
+		if _,e = h.Stat(id); e!=nil { t.Fatal(name,e) }
+	}
+}
@@ -0,0 +1,377 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "os"
+import "io"
+import "sort"
+import "sync"
+import "syscall"
+import "time"
+
+type memNode struct{
+	sb   Statbuf
+	data []byte
+	dir  map[string]uuid.UUID
+	xattr map[string][]byte
+}
+func (n *memNode) created() {
+	t := time.Now()
+	n.sb.ModTime,n.sb.Atime,n.sb.Ctime,n.sb.Btime = t,t,t,t
+}
+// The content has been modified.
+func (n *memNode) modified() {
+	n.sb.ModTime = time.Now()
+	n.sb.Ctime = n.sb.ModTime
+}
+// Only the metadata has been changed. Reads don't update the Atime.
+func (n *memNode) changed() {
+	n.sb.Ctime = time.Now()
+}
+
+// An in-memory LL_Facade. Nothing is written to disk, so the content is gone
+// once the MemFileSystem is dropped. Use Init() before use.
+type MemFileSystem struct {
+	lock  sync.RWMutex
+	nodes map[uuid.UUID]*memNode
+}
+func memErr(op string,id *uuid.UUID,name string,err error) error {
+	p := id.String()
+	if name!="" { p += "/"+name }
+	return &os.PathError{Op:op,Path:p,Err:err}
+}
+func (fs *MemFileSystem) Init() *MemFileSystem {
+	fs.nodes = make(map[uuid.UUID]*memNode)
+	return fs
+}
+func (fs *MemFileSystem) node(op string,id *uuid.UUID) (*memNode,error) {
+	n,ok := fs.nodes[*id]
+	if !ok { return nil,memErr(op,id,"",syscall.ENOENT) }
+	return n,nil
+}
+func (fs *MemFileSystem) dirNode(op string,id *uuid.UUID) (*memNode,error) {
+	n,e := fs.node(op,id)
+	if e!=nil { return nil,e }
+	if !n.sb.IsDir { return nil,memErr(op,id,"",syscall.ENOTDIR) }
+	return n,nil
+}
+func (fs *MemFileSystem) fileNode(op string,id *uuid.UUID) (*memNode,error) {
+	n,e := fs.node(op,id)
+	if e!=nil { return nil,e }
+	if n.sb.IsDir { return nil,memErr(op,id,"",syscall.EISDIR) }
+	return n,nil
+}
+func (fs *MemFileSystem) Mkfile(id *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	if n,ok := fs.nodes[*id]; ok {
+		if n.sb.IsDir { return memErr("mkfile",id,"",syscall.EISDIR) }
+		return nil
+	}
+	n := new(memNode)
+	n.sb.IsRegular = true
+	n.sb.Nlink = 1
+	n.sb.Mode = n.sb.DefaultMode()
+	n.created()
+	fs.nodes[*id] = n
+	return nil
+}
+func (fs *MemFileSystem) Mkdir(id *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	if _,ok := fs.nodes[*id]; ok { return memErr("mkdir",id,"",syscall.EEXIST) }
+	n := new(memNode)
+	n.sb.IsDir = true
+	n.sb.Nlink = 1
+	n.sb.Mode = n.sb.DefaultMode()
+	n.created()
+	n.dir = make(map[string]uuid.UUID)
+	fs.nodes[*id] = n
+	return nil
+}
+func (fs *MemFileSystem) Mksymlink(id *uuid.UUID,target string) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	if _,ok := fs.nodes[*id]; ok { return memErr("symlink",id,"",syscall.EEXIST) }
+	n := new(memNode)
+	n.sb.IsSymlink = true
+	n.sb.Nlink = 1
+	n.sb.Mode = n.sb.DefaultMode()
+	n.created()
+	n.data = []byte(target)
+	n.sb.Size = int64(len(n.data))
+	fs.nodes[*id] = n
+	return nil
+}
+func (fs *MemFileSystem) Readlink(id *uuid.UUID) (string,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.node("readlink",id)
+	if e!=nil { return "",e }
+	if !n.sb.IsSymlink { return "",memErr("readlink",id,"",syscall.EINVAL) }
+	return string(n.data),nil
+}
+func (fs *MemFileSystem) Lookup(id *uuid.UUID,name string) (*uuid.UUID,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.dirNode("lookup",id)
+	if e!=nil { return nil,e }
+	c,ok := n.dir[name]
+	if !ok { return nil,memErr("lookup",id,name,syscall.ENOENT) }
+	return &c,nil
+}
+func (fs *MemFileSystem) PutDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.dirNode("putdirent",id)
+	if e!=nil { return e }
+	if _,ok := n.dir[name]; ok { return memErr("putdirent",id,name,syscall.EEXIST) }
+	if _,ok := fs.nodes[*child]; !ok { return memErr("putdirent",child,"",syscall.ENOENT) }
+	n.dir[name] = *child
+	n.modified()
+	return nil
+}
+func (fs *MemFileSystem) LinkDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.dirNode("link",id)
+	if e!=nil { return e }
+	cn,e := fs.node("link",child)
+	if e!=nil { return e }
+	if cn.sb.IsDir { return memErr("link",child,"",syscall.EPERM) }
+	if _,ok := n.dir[name]; ok { return memErr("link",id,name,syscall.EEXIST) }
+	n.dir[name] = *child
+	n.modified()
+	cn.sb.Nlink++
+	cn.changed()
+	return nil
+}
+func (fs *MemFileSystem) SetDirent(id *uuid.UUID,name string, child *uuid.UUID) (*uuid.UUID,error) {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.dirNode("setdirent",id)
+	if e!=nil { return nil,e }
+	if _,ok := fs.nodes[*child]; !ok { return nil,memErr("setdirent",child,"",syscall.ENOENT) }
+	var old *uuid.UUID
+	if c,ok := n.dir[name]; ok { old = &c }
+	n.dir[name] = *child
+	n.modified()
+	return old,nil
+}
+func (fs *MemFileSystem) DropLink(id *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("droplink",id)
+	if e!=nil { return e }
+	if n.sb.Nlink>1 {
+		n.sb.Nlink--
+		n.changed()
+		return nil
+	}
+	if len(n.dir)>0 { return memErr("droplink",id,"",syscall.ENOTEMPTY) }
+	delete(fs.nodes,*id)
+	return nil
+}
+// Nothing is ever durable.
+func (fs *MemFileSystem) Fsync(id *uuid.UUID,dataOnly bool) error {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	_,e := fs.node("fsync",id)
+	return e
+}
+func (fs *MemFileSystem) DelDirent(id *uuid.UUID,name string) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.dirNode("deldirent",id)
+	if e!=nil { return e }
+	if _,ok := n.dir[name]; !ok { return memErr("deldirent",id,name,syscall.ENOENT) }
+	delete(n.dir,name)
+	n.modified()
+	return nil
+}
+func (fs *MemFileSystem) DelDirentFull(id *uuid.UUID,name string) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.dirNode("deldirent",id)
+	if e!=nil { return e }
+	c,ok := n.dir[name]
+	if !ok { return memErr("deldirent",id,name,syscall.ENOENT) }
+	cn,ok := fs.nodes[c]
+	if ok && len(cn.dir)>0 {
+		return memErr("deldirent",id,name,syscall.ENOTEMPTY)
+	}
+	delete(n.dir,name)
+	if ok && cn.sb.Nlink>1 {
+		cn.sb.Nlink--
+		cn.changed()
+	}else{
+		delete(fs.nodes,c)
+	}
+	n.modified()
+	return nil
+}
+func (fs *MemFileSystem) DelNode(id *uuid.UUID) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("delnode",id)
+	if e!=nil { return e }
+	if len(n.dir)>0 { return memErr("delnode",id,"",syscall.ENOTEMPTY) }
+	delete(fs.nodes,*id)
+	return nil
+}
+func (fs *MemFileSystem) Stat(id *uuid.UUID) (os.FileInfo, error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.node("stat",id)
+	if e!=nil { return nil,e }
+	return n.sb.FileInfo(id.String()),nil
+}
+func (fs *MemFileSystem) Chmod(id *uuid.UUID,mode uint32) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("chmod",id)
+	if e!=nil { return e }
+	n.sb.Mode = mode&07777
+	n.changed()
+	return nil
+}
+func (fs *MemFileSystem) Chown(id *uuid.UUID,uid, gid uint32) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("chown",id)
+	if e!=nil { return e }
+	if uid!=^uint32(0) { n.sb.Uid = uid }
+	if gid!=^uint32(0) { n.sb.Gid = gid }
+	n.changed()
+	return nil
+}
+func (fs *MemFileSystem) GetXAttr(id *uuid.UUID,name string) ([]byte,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.node("getxattr",id)
+	if e!=nil { return nil,e }
+	v,ok := n.xattr[name]
+	if !ok { return nil,memErr("getxattr",id,"",ErrNoAttr) }
+	return append([]byte{},v...),nil
+}
+func (fs *MemFileSystem) SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("setxattr",id)
+	if e!=nil { return e }
+	_,ok := n.xattr[name]
+	if ok && (flags&XAttrCreate)!=0 { return memErr("setxattr",id,"",syscall.EEXIST) }
+	if !ok && (flags&XAttrReplace)!=0 { return memErr("setxattr",id,"",ErrNoAttr) }
+	if n.xattr==nil { n.xattr = make(map[string][]byte) }
+	n.xattr[name] = append([]byte{},data...)
+	n.changed()
+	return nil
+}
+func (fs *MemFileSystem) ListXAttr(id *uuid.UUID) ([]string,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.node("listxattr",id)
+	if e!=nil { return nil,e }
+	names := make([]string,0,len(n.xattr))
+	for name := range n.xattr { names = append(names,name) }
+	sort.Strings(names)
+	return names,nil
+}
+func (fs *MemFileSystem) RemoveXAttr(id *uuid.UUID,name string) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("removexattr",id)
+	if e!=nil { return e }
+	if _,ok := n.xattr[name]; !ok { return memErr("removexattr",id,"",ErrNoAttr) }
+	delete(n.xattr,name)
+	n.changed()
+	return nil
+}
+func (fs *MemFileSystem) SetIno(id *uuid.UUID,ino uint64) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("setino",id)
+	if e!=nil { return e }
+	n.sb.Ino = ino
+	return nil
+}
+func (fs *MemFileSystem) Chtimes(id *uuid.UUID,atime time.Time, mtime time.Time) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.node("chtimes",id)
+	if e!=nil { return e }
+	n.sb.Atime = atime
+	n.sb.ModTime = mtime
+	n.changed()
+	return nil
+}
+func (fs *MemFileSystem) Truncate(id *uuid.UUID,size int64) error {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.fileNode("truncate",id)
+	if e!=nil { return e }
+	if size<0 { return memErr("truncate",id,"",syscall.EINVAL) }
+	if size<=int64(len(n.data)) {
+		n.data = n.data[:size]
+	}else{
+		n.data = append(n.data,make([]byte,size-int64(len(n.data)))...)
+	}
+	n.sb.Size = size
+	n.modified()
+	return nil
+}
+func (fs *MemFileSystem) ReadAt(id *uuid.UUID, b []byte, off int64) (int,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.fileNode("read",id)
+	if e!=nil { return 0,e }
+	if off<0 { return 0,memErr("read",id,"",syscall.EINVAL) }
+	if off>=int64(len(n.data)) { return 0,io.EOF }
+	i := copy(b,n.data[off:])
+	if i<len(b) { return i,io.EOF }
+	return i,nil
+}
+func (fs *MemFileSystem) WriteAt(id *uuid.UUID, b []byte, off int64) (int,error) {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.fileNode("write",id)
+	if e!=nil { return 0,e }
+	if off<0 { return 0,memErr("write",id,"",syscall.EINVAL) }
+	n.writeAt(b,off)
+	return len(b),nil
+}
+func (n *memNode) writeAt(b []byte, off int64) {
+	end := off+int64(len(b))
+	if end>int64(len(n.data)) {
+		n.data = append(n.data,make([]byte,end-int64(len(n.data)))...)
+	}
+	copy(n.data[off:],b)
+	n.sb.Size = int64(len(n.data))
+	n.modified()
+}
+func (fs *MemFileSystem) Append(id *uuid.UUID, b []byte) (int64,error) {
+	fs.lock.Lock(); defer fs.lock.Unlock()
+	n,e := fs.fileNode("append",id)
+	if e!=nil { return 0,e }
+	n.writeAt(b,int64(len(n.data)))
+	return n.sb.Size,nil
+}
+func (fs *MemFileSystem) Readdir(id *uuid.UUID,cookie string,max int) ([]string,string,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.dirNode("readdir",id)
+	if e!=nil { return nil,"",e }
+	names := []string{}
+	for name := range n.dir {
+		if name>cookie { names = append(names,name) }
+	}
+	return pageNames(names,max)
+}
+func (fs *MemFileSystem) Readdirnames(id *uuid.UUID) ([]string,error) {
+	fs.lock.RLock(); defer fs.lock.RUnlock()
+	n,e := fs.dirNode("readdir",id)
+	if e!=nil { return nil,e }
+	names := make([]string,0,len(n.dir))
+	for name := range n.dir { names = append(names,name) }
+	sort.Strings(names)
+	return names,nil
+}
+
@@ -0,0 +1,156 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "bufio"
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Node metadata, that the host filesystem can't represent, is kept in
+// extended attributes of the node, named metaPrefix+key. Where the host has
+// no user xattrs, it is kept in a sidecar file next to the node instead.
+const metaPrefix = "user.quickfs."
+
+// Values of the "type" metadata. Nodes without it are plain files or dirs.
+const nodeSymlink = "symlink"
+
+// The sidecar of a node is named sidecarPrefix+UUID. Dot names are reserved,
+// so it is not taken for a node.
+const sidecarPrefix = ".meta-"
+
+// Serializes updates of sidecar files.
+var sidecarLock sync.Mutex
+
+func sidecar(fn string) string {
+	return filepath.Dir(fn)+"/"+sidecarPrefix+filepath.Base(fn)
+}
+
+// Reads all metadata of the node fn at once.
+func readMeta(fn string) map[string]string {
+	m := make(map[string]string)
+	names,e := listxattr(fn)
+	if e==nil {
+		for _,name := range names {
+			if !strings.HasPrefix(name,metaPrefix) || strings.HasPrefix(name,xattrPrefix) { continue }
+			if b,e := getxattr(fn,name); e==nil { m[name[len(metaPrefix):]] = string(b) }
+		}
+	}
+	if len(m)==0 { readSidecar(fn,m) }
+	return m
+}
+func readSidecar(fn string,m map[string]string) {
+	b,e := ioutil.ReadFile(sidecar(fn))
+	if e!=nil { return }
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if i := strings.IndexByte(sc.Text(),'='); i>0 { m[sc.Text()[:i]] = sc.Text()[i+1:] }
+	}
+}
+func writeSidecar(fn,key,v string) error {
+	sidecarLock.Lock(); defer sidecarLock.Unlock()
+	if _,e := os.Lstat(fn); e!=nil { return e }
+	m := make(map[string]string)
+	readSidecar(fn,m)
+	m[key] = v
+	var buf bytes.Buffer
+	for k,v := range m { buf.WriteString(k+"="+v+"\n") }
+	// The new content must be durable, before it replaces the old one.
+	sc := sidecar(fn)
+	f,e := os.OpenFile(sc+".tmp",os.O_CREATE|os.O_TRUNC|os.O_WRONLY,0600)
+	if e!=nil { return e }
+	_,e = f.Write(buf.Bytes())
+	if e==nil { e = f.Sync() }
+	f.Close()
+	if e==nil { e = os.Rename(sc+".tmp",sc) }
+	if e!=nil { os.Remove(sc+".tmp") }
+	return e
+}
+
+func getMetaString(fn,key string) string {
+	return readMeta(fn)[key]
+}
+func setMetaString(fn,key,v string) error {
+	e := setxattr(fn,metaPrefix+key,[]byte(v),0)
+	if e!=nil && xattrUnsupported(e) { e = writeSidecar(fn,key,v) }
+	return e
+}
+
+func getMetaUint(fn,key string,def uint64) uint64 {
+	return parseMetaUint(readMeta(fn),key,def)
+}
+func parseMetaUint(m map[string]string,key string,def uint64) uint64 {
+	s,ok := m[key]
+	if !ok { return def }
+	v,e := strconv.ParseUint(s,10,64)
+	if e!=nil { return def }
+	return v
+}
+func setMetaUint(fn,key string,v uint64) error {
+	return setMetaString(fn,key,strconv.FormatUint(v,10))
+}
+
+// Records the creation time of a new node. The host doesn't reliably keep it.
+func setBtime(fn string) {
+	setMetaUint(fn,"btime",uint64(time.Now().UnixNano()))
+}
+
+// Removes the node fn along with its sidecar.
+func removeNode(fn string) error {
+	e := os.Remove(fn)
+	if e==nil { os.Remove(sidecar(fn)) }
+	return e
+}
+// Moves the node fn along with its sidecar. The sidecar goes first, so an
+// interrupted move can be completed by repeating it.
+func moveNode(fn,nfn string) error {
+	if e := os.Rename(sidecar(fn),sidecar(nfn)); e!=nil && !os.IsNotExist(e) { return e }
+	return os.Rename(fn,nfn)
+}
+
+// Complements the FileInfo of the node fn with its metadata.
+func (fs *FileSystem) statInfo(fn string,fi os.FileInfo) os.FileInfo {
+	var sb Statbuf
+	sb.FromFileInfo(fi)
+	m := readMeta(fn)
+	sb.Nlink = 1
+	if !sb.IsDir { sb.Nlink = uint32(parseMetaUint(m,"nlink",1)) }
+	if sb.IsRegular && m["type"]==nodeSymlink {
+		sb.IsRegular = false
+		sb.IsSymlink = true
+	}
+	sb.Mode = uint32(parseMetaUint(m,"mode",uint64(sb.DefaultMode())))
+	sb.Uid  = uint32(parseMetaUint(m,"uid",0))
+	sb.Gid  = uint32(parseMetaUint(m,"gid",0))
+	sb.Ino = parseMetaUint(m,"ino",0)
+	if t := parseMetaUint(m,"btime",0); t!=0 { sb.Btime = time.Unix(0,int64(t)) }
+	return sb.FileInfo(fi.Name())
+}
@@ -0,0 +1,66 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "os"
+import "path/filepath"
+
+// Rewrites dirents with absolute symlink targets, as written by older
+// versions, into plain UUID targets. Returns the number of rewritten dirents.
+// Each dirent is replaced atomically, so this can be run on a store served
+// through the same *FileSystem, but not on one used by another process.
+func (fs *FileSystem) MigrateDirents() (n int,err error) {
+	err = fs.WalkNodes(func(id *uuid.UUID) error {
+		dn := fs.extrude(id)
+		st,e := os.Lstat(dn)
+		if e!=nil || !st.IsDir() { return nil }
+		d,e := os.Open(dn)
+		if e!=nil { return e }
+		names,e := d.Readdirnames(0)
+		d.Close()
+		if e!=nil { return e }
+		for _,name := range names {
+			tgt,e := os.Readlink(dn+"/"+name)
+			if e!=nil || tgt==filepath.Base(tgt) { continue }
+			if _,e = fs.deextrude(tgt); e!=nil { continue }
+			ok,e := fs.migrateDirent(dn+"/"+name,tgt)
+			if e!=nil { return e }
+			if ok { n++ }
+		}
+		return nil
+	})
+	return
+}
+// Rewrites the dirent fn, unless it has been changed or removed meanwhile.
+func (fs *FileSystem) migrateDirent(fn,tgt string) (bool,error) {
+	fs.links.Lock(); defer fs.links.Unlock()
+	if cur,e := os.Readlink(fn); e!=nil || cur!=tgt { return false,nil }
+	cid,e := fs.deextrude(tgt)
+	if e!=nil { return false,nil }
+	return true,fs.replaceLink(fn,cid.String())
+}
+
@@ -26,12 +26,42 @@ SOFTWARE.
 package quickfs
 
 import "github.com/nu7hatch/gouuid"
+import "io/ioutil"
 import "os"
 import "path/filepath"
+import "sync"
+import "syscall"
 import "time"
 
 type FileSystem struct {
 	Prefix string
+	
+	// Number of hex-prefix fan-out levels, the nodes are placed in (see
+	// LoadLayout). 0 is the flat layout. It must match the backing store, only
+	// Convert changes it.
+	Levels int
+	
+	lock sync.RWMutex
+	oldLevels int
+	converting bool
+	
+	markLock sync.Mutex
+	marked bool
+	
+	// Held while a node is created, and exclusively while an empty fan-out
+	// directory is removed.
+	shards sync.RWMutex
+	
+	// Serializes changes of dirents and link counts.
+	links sync.Mutex
+	
+	// Called, when the dirents of a directory have changed. Set by
+	// CachedFileSystem.Init.
+	changed func(id *uuid.UUID)
+	
+	// Nodes created or linked while a GC runs (see GC.Run). Nil otherwise.
+	track sync.Mutex
+	tracked map[uuid.UUID]bool
 }
 func (fs *FileSystem) extrude(id *uuid.UUID) string {
 	r,_ := fs.extrude2(id)
@@ -39,40 +69,249 @@ func (fs *FileSystem) extrude(id *uuid.UUID) string {
 }
 func (fs *FileSystem) extrude2(id *uuid.UUID) (string,string) {
 	ids := id.String()
-	return fs.Prefix+id.String(),ids
+	fs.lock.RLock()
+	levels,old,conv := fs.Levels,fs.oldLevels,fs.converting
+	fs.lock.RUnlock()
+	p := fs.Prefix+shard(ids,levels)+ids
+	if conv {
+		// The node might not have been moved yet.
+		if _,e := os.Lstat(p); os.IsNotExist(e) {
+			p = fs.Prefix+shard(ids,old)+ids
+		}
+	}
+	return p,ids
+}
+
+// Like extrude, but for new nodes. Creates the fan-out directories. The
+// caller must hold fs.shards, until the node is created.
+func (fs *FileSystem) extrudeNew(id *uuid.UUID) (string,error) {
+	if e := fs.checkLayout(); e!=nil { return "",e }
+	fs.trackNode(id)
+	ids := id.String()
+	fs.lock.RLock()
+	levels := fs.Levels
+	fs.lock.RUnlock()
+	if levels==0 { return fs.Prefix+ids,nil }
+	d := fs.Prefix+shard(ids,levels)
+	if _,e := os.Lstat(d); !os.IsNotExist(e) { return d+ids,nil }
+	if e := os.MkdirAll(d,0700); e!=nil { return "",e }
+	// Make new fan-out directories durable, Fsync only covers the last one.
+	for i := 0; i<levels; i++ {
+		if e := syncDir(fs.Prefix+shard(ids,i)); e!=nil { return "",e }
+	}
+	return d+ids,nil
 }
 func (fs *FileSystem) deextrude(s string) (*uuid.UUID,error){
 	s = filepath.Base(s)
 	return uuid.ParseHex(s)
 }
 func (fs *FileSystem) Open(id *uuid.UUID,flag int) (*os.File, error) {
-	return os.OpenFile(fs.extrude(id),flag,0600)
+	fn := fs.extrude(id)
+	created := false
+	if (flag&os.O_CREATE)!=0 {
+		if _,e := os.Lstat(fn); os.IsNotExist(e) {
+			fs.shards.RLock(); defer fs.shards.RUnlock()
+			fn,e = fs.extrudeNew(id)
+			if e!=nil { return nil,e }
+			created = true
+		}
+	}
+	f,e := os.OpenFile(fn,flag,0600)
+	if e==nil && created { setBtime(fn) }
+	return f,e
 }
 func (fs *FileSystem) Mkdir(id *uuid.UUID) error {
-	return os.Mkdir(fs.extrude(id),0700)
+	if _,e := os.Lstat(fs.extrude(id)); e==nil {
+		return &os.PathError{Op:"mkdir",Path:fs.extrude(id),Err:syscall.EEXIST}
+	}
+	fs.shards.RLock(); defer fs.shards.RUnlock()
+	fn,e := fs.extrudeNew(id)
+	if e!=nil { return e }
+	e = os.Mkdir(fn,0700)
+	if e==nil { setBtime(fn) }
+	return e
+}
+// Symlink nodes are regular files holding the target, that are marked as
+// symlinks in their metadata. Host symlinks are not used, as the host would
+// follow them.
+func (fs *FileSystem) Mksymlink(id *uuid.UUID,target string) error {
+	fs.shards.RLock(); defer fs.shards.RUnlock()
+	fn,e := fs.extrudeNew(id)
+	if e!=nil { return e }
+	f,e := os.OpenFile(fn,os.O_CREATE|os.O_EXCL|os.O_WRONLY,0600)
+	if e!=nil { return e }
+	_,e = f.WriteString(target)
+	if e==nil { e = setMetaString(fn,"type",nodeSymlink) }
+	if e==nil { setBtime(fn) }
+	if e==nil { e = f.Sync() }
+	f.Close()
+	if e!=nil { removeNode(fn) }
+	return e
+}
+func (fs *FileSystem) Readlink(id *uuid.UUID) (string,error) {
+	fn := fs.extrude(id)
+	if getMetaString(fn,"type")!=nodeSymlink {
+		return "",&os.PathError{Op:"readlink",Path:fn,Err:syscall.EINVAL}
+	}
+	b,e := ioutil.ReadFile(fn)
+	return string(b),e
 }
 func (fs *FileSystem) Lookup(id *uuid.UUID,name string) (*uuid.UUID,error) {
 	s,e := os.Readlink(fs.extrude(id)+"/"+name)
 	if e!=nil { return nil,e }
 	return fs.deextrude(s)
 }
+// Dirents are symlinks, whose target is the plain UUID of the child, so the
+// backing store can be moved around. Older stores used absolute targets,
+// which are still understood (see MigrateDirents).
 func (fs *FileSystem) PutDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
-	return os.Symlink(fs.extrude(child),fs.extrude(id)+"/"+name)
+	fs.links.Lock(); defer fs.links.Unlock()
+	return fs.putDirent(id,name,child)
+}
+func (fs *FileSystem) putDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	fs.trackNode(child)
+	defer fs.direntsChanged(id)
+	return os.Symlink(child.String(),fs.extrude(id)+"/"+name)
+}
+func (fs *FileSystem) direntsChanged(id *uuid.UUID) {
+	if fs.changed!=nil { fs.changed(id) }
+}
+// Adds an additional dirent (a hard link) for the child, and increments its
+// link count. Directories can't be linked.
+func (fs *FileSystem) LinkDirent(id *uuid.UUID,name string, child *uuid.UUID) error {
+	fn := fs.extrude(child)
+	fs.links.Lock(); defer fs.links.Unlock()
+	st,e := os.Stat(fn)
+	if e!=nil { return e }
+	if st.IsDir() { return &os.LinkError{Op:"link",Old:fn,New:name,Err:syscall.EPERM} }
+	n := getMetaUint(fn,"nlink",1)
+	e = setMetaUint(fn,"nlink",n+1)
+	if e!=nil { return e }
+	e = fs.putDirent(id,name,child)
+	if e!=nil { setMetaUint(fn,"nlink",n) }
+	return e
+}
+// Temporary symlinks in the reserved namespace of the backing store start
+// with this. Leftovers of a crash are removed by Recover.
+const renamePrefix = ".rename-"
+
+// Points the symlink fn at target atomically, by renaming a fresh symlink
+// over it. Call with fs.links held.
+func (fs *FileSystem) replaceLink(fn,target string) error {
+	tid,e := uuid.NewV4()
+	if e!=nil { return e }
+	tmp := fs.Prefix+renamePrefix+tid.String()
+	if e = os.Symlink(target,tmp); e!=nil { return e }
+	if e = os.Rename(tmp,fn); e!=nil {
+		os.Remove(tmp)
+		return e
+	}
+	return nil
+}
+func (fs *FileSystem) SetDirent(id *uuid.UUID,name string, child *uuid.UUID) (*uuid.UUID,error) {
+	fs.links.Lock(); defer fs.links.Unlock()
+	old,e := fs.Lookup(id,name)
+	if e!=nil && !os.IsNotExist(e) { return nil,e }
+	fs.trackNode(child)
+	defer fs.direntsChanged(id)
+	if e = fs.replaceLink(fs.extrude(id)+"/"+name,child.String()); e!=nil { return nil,e }
+	return old,nil
+}
+// Drops the link count of a node, that lost a dirent through SetDirent. The
+// node is removed, once it is not linked anymore.
+func (fs *FileSystem) DropLink(id *uuid.UUID) error {
+	fn := fs.extrude(id)
+	fs.links.Lock(); defer fs.links.Unlock()
+	if _,e := os.Lstat(fn); e!=nil { return e }
+	if n := getMetaUint(fn,"nlink",1); n>1 { return setMetaUint(fn,"nlink",n-1) }
+	return removeNode(fn)
 }
 func (fs *FileSystem) DelDirent(id *uuid.UUID,name string) error {
+	fs.links.Lock(); defer fs.links.Unlock()
+	defer fs.direntsChanged(id)
 	return os.Remove(fs.extrude(id)+"/"+name)
 }
+func (fs *FileSystem) checkEmpty(fn string) error {
+	d,e := os.Open(fn)
+	if e!=nil { return e }
+	defer d.Close()
+	st,e := d.Stat()
+	if e!=nil || !st.IsDir() { return e }
+	names,_ := d.Readdirnames(1)
+	if len(names)>0 { return &os.PathError{Op:"remove",Path:fn,Err:syscall.ENOTEMPTY} }
+	return nil
+}
+// Removes the dirent and decrements the link count of the child. The child
+// is removed, once it drops to zero.
 func (fs *FileSystem) DelDirentFull(id *uuid.UUID,name string) error {
-	cld,err := os.Readlink(fs.extrude(id)+"/"+name)
+	fs.links.Lock(); defer fs.links.Unlock()
+	cld,err := fs.Lookup(id,name)
+	n := uint64(1)
+	if err==nil {
+		cn := fs.extrude(cld)
+		// Don't leave a dangling node behind, if it can't be removed.
+		if e := fs.checkEmpty(cn); e!=nil && !os.IsNotExist(e) { return e }
+		n = getMetaUint(cn,"nlink",1)
+	}
 	e := os.Remove(fs.extrude(id)+"/"+name)
 	if e!=nil { return e }
+	fs.direntsChanged(id)
 	if err==nil {
-		e = os.Remove(cld)
+		if n>1 { return setMetaUint(fs.extrude(cld),"nlink",n-1) }
+		e = removeNode(fs.extrude(cld))
 	}
 	return e
 }
+func (fs *FileSystem) DelNode(id *uuid.UUID) error {
+	return removeNode(fs.extrude(id))
+}
 func (fs *FileSystem) Stat(id *uuid.UUID) (os.FileInfo, error) {
-	return os.Stat(fs.extrude(id))
+	fn := fs.extrude(id)
+	fi,e := os.Stat(fn)
+	if e!=nil { return nil,e }
+	return fs.statInfo(fn,fi),nil
+}
+// The mode of a node is kept in its metadata, the backing file itself is
+// always private to the server.
+func (fs *FileSystem) Chmod(id *uuid.UUID,mode uint32) error {
+	return setMetaUint(fs.extrude(id),"mode",uint64(mode&07777))
+}
+func (fs *FileSystem) Chown(id *uuid.UUID,uid, gid uint32) error {
+	fn := fs.extrude(id)
+	if _,e := os.Lstat(fn); e!=nil { return e }
+	if uid!=^uint32(0) {
+		if e := setMetaUint(fn,"uid",uint64(uid)); e!=nil { return e }
+	}
+	if gid!=^uint32(0) {
+		if e := setMetaUint(fn,"gid",uint64(gid)); e!=nil { return e }
+	}
+	return nil
+}
+// Dirents live in the directory node itself, and metadata in xattrs of the
+// node, so syncing the node covers both. Where metadata is kept in a sidecar
+// file, that is synced by syncEntry, along with the entry of the node in the
+// backing store, as the node may be new.
+func (fs *FileSystem) Fsync(id *uuid.UUID,dataOnly bool) error {
+	f,e := os.Open(fs.extrude(id))
+	if e!=nil { return e }
+	e = syncFile(f,dataOnly)
+	f.Close()
+	if e!=nil { return e }
+	return fs.syncEntry(id)
+}
+// The sidecar is in the same directory as the node.
+func (fs *FileSystem) syncEntry(id *uuid.UUID) error {
+	fn := fs.extrude(id)
+	if f,e := os.Open(sidecar(fn)); e==nil {
+		e = f.Sync()
+		f.Close()
+		if e!=nil { return e }
+	}
+	return syncDir(filepath.Dir(fn))
+}
+func syncFile(f *os.File,dataOnly bool) error {
+	if dataOnly { return fdatasync(f) }
+	return f.Sync()
 }
 func (fs *FileSystem) Chtimes(id *uuid.UUID,atime time.Time, mtime time.Time) error {
 	return os.Chtimes(fs.extrude(id),atime,mtime)
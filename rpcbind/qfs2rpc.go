@@ -30,6 +30,8 @@ import "github.com/byte-mug/quickfs"
 import "net/rpc"
 import "github.com/nu7hatch/gouuid"
 import "errors"
+import "io"
+import "syscall"
 import "time"
 
 /*
@@ -58,24 +60,36 @@ func join3(a,b,c error) error {
 	return c
 }
 
+// Code is a quickfs.Code. Peers, that predate it, send 0.
 type Errcon struct{
 	Msg string
 	Bad bool
+	Code int
 }
+
+// Sent as Code for io.EOF, which has no errno.
+const codeEOF = -1
+
 func (e *Errcon) From(r error) error {
 	if r!=nil {
-		*e = Errcon{r.Error(),true}
+		*e = Errcon{r.Error(),true,int(quickfs.CodeOf(r))}
+		if r==io.EOF { e.Code = codeEOF }
 	}else{
-		*e = Errcon{"",false}
+		*e = Errcon{"",false,0}
 	}
 	return nil
 }
 func (e *Errcon) To() error {
 	if !e.Bad { return nil }
-	return errors.New(e.Msg)
+	switch e.Code {
+	case 0: return errors.New(e.Msg)
+	case codeEOF: return io.EOF
+	}
+	return &quickfs.Error{Code:quickfs.Code(e.Code),Msg:e.Msg}
 }
 
-// Wraps a RPC client into a QuickFS facade
+// Wraps a RPC client into a QuickFS facade. The result also implements
+// quickfs.XAttrFacade.
 func FacadeFrom(c *rpc.Client) quickfs.Facade2 {
 	return &QuickfsClient{c}
 }
@@ -95,6 +109,8 @@ type QuickfsClient struct{
 type QLookup struct{
 	Id []byte
 	Name string
+	Flags int // HLMkdir and HLMkfile only.
+	Attr *quickfs.NodeAttr // HLMkdir and HLMkfile only, may be nil.
 }
 type ALookup struct{
 	Id []byte
@@ -204,19 +220,94 @@ func (c *QuickfsClient) Readdirnames(id *uuid.UUID) ([]string,error) {
 	e1 := a.Err.To()
 	return a.Names,join2(e1,e2)
 }
+type QReaddirPage struct{
+	Id []byte
+	Cookie string
+	Max int
+}
+type AReaddirPage struct{
+	Names []string
+	Next string
+	Err Errcon
+}
+func (f *QuickfsFacade) ReaddirPage(q *QReaddirPage, a *AReaddirPage) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	a.Names,a.Next,e = f.Facade.Readdir(id,q.Cookie,q.Max)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) Readdir(id *uuid.UUID,cookie string,max int) ([]string,string,error) {
+	var q QReaddirPage
+	var a AReaddirPage
+	q.Id = slaughter(id)
+	q.Cookie = cookie
+	q.Max = max
+	e2 := c.Client.Call("QuickfsFacade.ReaddirPage",q,&a)
+	e1 := a.Err.To()
+	return a.Names,a.Next,join2(e1,e2)
+}
+
+type QFsync struct{
+	Id []byte
+	DataOnly bool
+}
+func (f *QuickfsFacade) Fsync(q *QFsync, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	e = f.Facade.Fsync(id,q.DataOnly)
+	return a.From(e)
+}
+func (c *QuickfsClient) Fsync(id *uuid.UUID,dataOnly bool) error {
+	var q QFsync
+	var a Errcon
+	q.Id = slaughter(id)
+	q.DataOnly = dataOnly
+	e2 := c.Client.Call("QuickfsFacade.Fsync",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+
+type QAppend struct{
+	Id []byte
+	Data []byte
+}
+type AAppend struct{
+	End int64
+	Err Errcon
+}
+func (f *QuickfsFacade) Append(q *QAppend, a *AAppend) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	a.End,e = f.Facade.Append(id,q.Data)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) Append(id *uuid.UUID, b []byte) (int64,error) {
+	var q QAppend
+	var a AAppend
+	q.Id = slaughter(id)
+	q.Data = b
+	e2 := c.Client.Call("QuickfsFacade.Append",q,&a)
+	e1 := a.Err.To()
+	return a.End,join2(e1,e2)
+}
 
 func (f *QuickfsFacade) HLMkdir(q *QLookup, a *ALookup) error {
 	id,e := uuid.Parse(q.Id)
 	if e!=nil { return a.Err.From(e) }
-	id,e = f.Facade.HL_Mkdir(id,q.Name)
+	id,e = f.Facade.HL_MkdirAttr(id,q.Name,q.Flags,q.Attr)
 	a.Id = slaughter(id)
 	return a.Err.From(e)
 }
-func (c *QuickfsClient) HL_Mkdir(id *uuid.UUID,name string) (*uuid.UUID,error) {
+func (c *QuickfsClient) HL_Mkdir(id *uuid.UUID,name string,flags int) (*uuid.UUID,error) {
+	return c.HL_MkdirAttr(id,name,flags,nil)
+}
+func (c *QuickfsClient) HL_MkdirAttr(id *uuid.UUID,name string,flags int,attr *quickfs.NodeAttr) (*uuid.UUID,error) {
 	var q QLookup
 	var a ALookup
 	q.Id = slaughter(id)
 	q.Name = name
+	q.Flags = flags
+	q.Attr = attr
 	e3 := c.Client.Call("QuickfsFacade.HLMkdir",q,&a)
 	nid,e2 := uuid.Parse(a.Id)
 	e1 := a.Err.To()
@@ -225,15 +316,20 @@ func (c *QuickfsClient) HL_Mkdir(id *uuid.UUID,name string) (*uuid.UUID,error) {
 func (f *QuickfsFacade) HLMkfile(q *QLookup, a *ALookup) error {
 	id,e := uuid.Parse(q.Id)
 	if e!=nil { return a.Err.From(e) }
-	id,e = f.Facade.HL_Mkfile(id,q.Name)
+	id,e = f.Facade.HL_MkfileAttr(id,q.Name,q.Flags,q.Attr)
 	a.Id = slaughter(id)
 	return a.Err.From(e)
 }
-func (c *QuickfsClient) HL_Mkfile(id *uuid.UUID,name string) (*uuid.UUID,error) {
+func (c *QuickfsClient) HL_Mkfile(id *uuid.UUID,name string,flags int) (*uuid.UUID,error) {
+	return c.HL_MkfileAttr(id,name,flags,nil)
+}
+func (c *QuickfsClient) HL_MkfileAttr(id *uuid.UUID,name string,flags int,attr *quickfs.NodeAttr) (*uuid.UUID,error) {
 	var q QLookup
 	var a ALookup
 	q.Id = slaughter(id)
 	q.Name = name
+	q.Flags = flags
+	q.Attr = attr
 	e3 := c.Client.Call("QuickfsFacade.HLMkfile",q,&a)
 	nid,e2 := uuid.Parse(a.Id)
 	e1 := a.Err.To()
@@ -263,6 +359,45 @@ func (c *QuickfsClient) HL_Stat  (id *uuid.UUID, sb *quickfs.Statbuf) error {
 	return join2(a.Err.To(),e)
 }
 
+type RDirEntry struct{
+	Name string
+	Id []byte
+	Stat quickfs.Statbuf
+}
+type AReadDirPlus struct{
+	Entries []RDirEntry
+	Next string
+	Err Errcon
+}
+func (f *QuickfsFacade) HLReadDirPlus(q *QReaddirPage, a *AReadDirPlus) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	ents,next,e := f.Facade.HL_ReadDirPlus(id,q.Cookie,q.Max)
+	a.Next = next
+	a.Entries = make([]RDirEntry,len(ents))
+	for i,ent := range ents {
+		a.Entries[i] = RDirEntry{ent.Name,slaughter(ent.Id),ent.Stat}
+	}
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) HL_ReadDirPlus(id *uuid.UUID,cookie string,max int) ([]quickfs.DirEntry,string,error) {
+	var q QReaddirPage
+	var a AReadDirPlus
+	q.Id = slaughter(id)
+	q.Cookie = cookie
+	q.Max = max
+	e2 := c.Client.Call("QuickfsFacade.HLReadDirPlus",q,&a)
+	e1 := a.Err.To()
+	if e:=join2(e1,e2); e!=nil { return nil,"",e }
+	ents := make([]quickfs.DirEntry,0,len(a.Entries))
+	for _,ent := range a.Entries {
+		cid,e := uuid.Parse(ent.Id)
+		if e!=nil { return nil,"",e }
+		ents = append(ents,quickfs.DirEntry{Name:ent.Name,Id:cid,Stat:ent.Stat})
+	}
+	return ents,a.Next,nil
+}
+
 func (f *QuickfsFacade) HLDelete(q *QLookup, a *Errcon) error {
 	id,e := uuid.Parse(q.Id)
 	if e!=nil { return a.From(e) }
@@ -278,6 +413,81 @@ func (c *QuickfsClient) HL_Delete(id *uuid.UUID,name string) error {
 	e1 := a.To()
 	return join2(e1,e2)
 }
+func (f *QuickfsFacade) HLDeleteTree(q *QLookup, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	e = f.Facade.HL_DeleteTree(id,q.Name)
+	return a.From(e)
+}
+func (c *QuickfsClient) HL_DeleteTree(id *uuid.UUID,name string) error {
+	var q QLookup
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Name = name
+	e2 := c.Client.Call("QuickfsFacade.HLDeleteTree",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+
+
+
+type QLookupIno struct{
+	Ino uint64
+}
+func (f *QuickfsFacade) HLLookupIno(q *QLookupIno, a *ALookup) error {
+	id,e := f.Facade.HL_LookupIno(q.Ino)
+	a.Id = slaughter(id)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) HL_LookupIno(ino uint64) (*uuid.UUID,error) {
+	var q QLookupIno
+	var a ALookup
+	q.Ino = ino
+	e3 := c.Client.Call("QuickfsFacade.HLLookupIno",q,&a)
+	nid,e2 := uuid.Parse(a.Id)
+	e1 := a.Err.To()
+	return nid,join3(e1,e2,e3)
+}
+
+type QChmod struct{
+	Id []byte
+	Mode uint32
+}
+func (f *QuickfsFacade) HLChmod(q *QChmod, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	e = f.Facade.HL_Chmod(id,q.Mode)
+	return a.From(e)
+}
+func (c *QuickfsClient) HL_Chmod(id *uuid.UUID,mode uint32) error {
+	var q QChmod
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Mode = mode
+	e2 := c.Client.Call("QuickfsFacade.HLChmod",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+type QChown struct{
+	Id []byte
+	Uid,Gid uint32
+}
+func (f *QuickfsFacade) HLChown(q *QChown, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	e = f.Facade.HL_Chown(id,q.Uid,q.Gid)
+	return a.From(e)
+}
+func (c *QuickfsClient) HL_Chown(id *uuid.UUID,uid, gid uint32) error {
+	var q QChown
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Uid = uid
+	q.Gid = gid
+	e2 := c.Client.Call("QuickfsFacade.HLChown",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
 
 
 
@@ -320,9 +530,175 @@ func (c *QuickfsClient) HL_ReadAt2(id *uuid.UUID, size int, off int64) ([]byte,e
 
 
 
+type QLink struct {
+	Id []byte
+	Name string
+	Target []byte
+}
+
+func (f *QuickfsFacade) HLLink(q *QLink, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	tid,e := uuid.Parse(q.Target)
+	if e!=nil { return a.From(e) }
+	e = f.Facade.HL_Link(id,q.Name,tid)
+	return a.From(e)
+}
+func (c *QuickfsClient) HL_Link(id *uuid.UUID,name string, target *uuid.UUID) error {
+	var q QLink
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Name = name
+	q.Target = slaughter(target)
+	e2 := c.Client.Call("QuickfsFacade.HLLink",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+
+
+
+type QSymlink struct {
+	Id []byte
+	Name string
+	Target string
+	Attr *quickfs.NodeAttr // may be nil
+}
+type AReadlink struct {
+	Target string
+	Err Errcon
+}
+
+func (f *QuickfsFacade) HLSymlink(q *QSymlink, a *ALookup) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	id,e = f.Facade.HL_SymlinkAttr(id,q.Name,q.Target,q.Attr)
+	a.Id = slaughter(id)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) HL_Symlink(id *uuid.UUID,name string, target string) (*uuid.UUID,error) {
+	return c.HL_SymlinkAttr(id,name,target,nil)
+}
+func (c *QuickfsClient) HL_SymlinkAttr(id *uuid.UUID,name string, target string,attr *quickfs.NodeAttr) (*uuid.UUID,error) {
+	var q QSymlink
+	var a ALookup
+	q.Id = slaughter(id)
+	q.Name = name
+	q.Target = target
+	q.Attr = attr
+	e3 := c.Client.Call("QuickfsFacade.HLSymlink",q,&a)
+	nid,e2 := uuid.Parse(a.Id)
+	e1 := a.Err.To()
+	return nid,join3(e1,e2,e3)
+}
+func (f *QuickfsFacade) HLReadlink(q *QStat, a *AReadlink) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	a.Target,e = f.Facade.HL_Readlink(id)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) HL_Readlink(id *uuid.UUID) (string,error) {
+	var q QStat
+	var a AReadlink
+	q.Id = slaughter(id)
+	e2 := c.Client.Call("QuickfsFacade.HLReadlink",q,&a)
+	e1 := a.Err.To()
+	return a.Target,join2(e1,e2)
+}
+
+
+
+type QXAttr struct{
+	Id []byte
+	Name string
+	Data []byte
+	Flags int
+}
+type AXAttr struct{
+	Data []byte
+	Names []string
+	Err Errcon
+}
+func (f *QuickfsFacade) xattrs() (quickfs.XAttrFacade,error) {
+	x,ok := f.Facade.(quickfs.XAttrFacade)
+	if !ok { return nil,syscall.ENOTSUP }
+	return x,nil
+}
+func (f *QuickfsFacade) GetXAttr(q *QXAttr, a *AXAttr) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	x,e := f.xattrs()
+	if e!=nil { return a.Err.From(e) }
+	a.Data,e = x.GetXAttr(id,q.Name)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) GetXAttr(id *uuid.UUID,name string) ([]byte,error) {
+	var q QXAttr
+	var a AXAttr
+	q.Id = slaughter(id)
+	q.Name = name
+	e2 := c.Client.Call("QuickfsFacade.GetXAttr",q,&a)
+	e1 := a.Err.To()
+	return a.Data,join2(e1,e2)
+}
+func (f *QuickfsFacade) SetXAttr(q *QXAttr, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	x,e := f.xattrs()
+	if e!=nil { return a.From(e) }
+	e = x.SetXAttr(id,q.Name,q.Data,q.Flags)
+	return a.From(e)
+}
+func (c *QuickfsClient) SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error {
+	var q QXAttr
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Name = name
+	q.Data = data
+	q.Flags = flags
+	e2 := c.Client.Call("QuickfsFacade.SetXAttr",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+func (f *QuickfsFacade) ListXAttr(q *QXAttr, a *AXAttr) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.Err.From(e) }
+	x,e := f.xattrs()
+	if e!=nil { return a.Err.From(e) }
+	a.Names,e = x.ListXAttr(id)
+	return a.Err.From(e)
+}
+func (c *QuickfsClient) ListXAttr(id *uuid.UUID) ([]string,error) {
+	var q QXAttr
+	var a AXAttr
+	q.Id = slaughter(id)
+	e2 := c.Client.Call("QuickfsFacade.ListXAttr",q,&a)
+	e1 := a.Err.To()
+	return a.Names,join2(e1,e2)
+}
+func (f *QuickfsFacade) RemoveXAttr(q *QXAttr, a *Errcon) error {
+	id,e := uuid.Parse(q.Id)
+	if e!=nil { return a.From(e) }
+	x,e := f.xattrs()
+	if e!=nil { return a.From(e) }
+	e = x.RemoveXAttr(id,q.Name)
+	return a.From(e)
+}
+func (c *QuickfsClient) RemoveXAttr(id *uuid.UUID,name string) error {
+	var q QXAttr
+	var a Errcon
+	q.Id = slaughter(id)
+	q.Name = name
+	e2 := c.Client.Call("QuickfsFacade.RemoveXAttr",q,&a)
+	e1 := a.To()
+	return join2(e1,e2)
+}
+
+
+
 type QMovelink struct {
 	Oid, Nid []byte
 	Oname, Nname string
+	Flags int
 }
 
 func (f *QuickfsFacade) HLMovelink(q *QMovelink, a *Errcon) error {
@@ -330,16 +706,17 @@ func (f *QuickfsFacade) HLMovelink(q *QMovelink, a *Errcon) error {
 	if e!=nil { return a.From(e) }
 	nid,e := uuid.Parse(q.Nid)
 	if e!=nil { return a.From(e) }
-	e = f.Facade.HL_Movelink(oid,q.Oname,nid,q.Nname)
+	e = f.Facade.HL_Movelink(oid,q.Oname,nid,q.Nname,q.Flags)
 	return a.From(e)
 }
-func (c *QuickfsClient) HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string) error {
+func (c *QuickfsClient) HL_Movelink(oid *uuid.UUID, oname string, nid *uuid.UUID, nname string, flags int) error {
 	var q QMovelink
 	var a Errcon
 	q.Oid = slaughter(oid)
 	q.Nid = slaughter(nid)
 	q.Oname = oname
 	q.Nname = nname
+	q.Flags = flags
 	e2 := c.Client.Call("QuickfsFacade.HLMovelink",q,&a)
 	e1 := a.To()
 	return join2(e1,e2)
@@ -0,0 +1,85 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package rpcbind
+
+import "github.com/byte-mug/quickfs"
+import "github.com/nu7hatch/gouuid"
+import "errors"
+import "io"
+import "io/fs"
+import "net"
+import "net/rpc"
+import "syscall"
+import "testing"
+
+// Connects a client to a memfs-backed server over a pipe.
+func pipe(t *testing.T) quickfs.Facade2 {
+	m := new(quickfs.MemFileSystem).Init()
+	m.Mkdir(uuid.NamespaceURL)
+	srv := rpc.NewServer()
+	if e := FacadeTo(&quickfs.HL_Wrap{LL_Facade:m},srv); e!=nil { t.Fatal(e) }
+	a,b := net.Pipe()
+	go srv.ServeConn(a)
+	c := rpc.NewClient(b)
+	t.Cleanup(func() { c.Close() })
+	return FacadeFrom(c)
+}
+
+// Errors keep their meaning across the wire.
+func TestErrors(t *testing.T) {
+	c := pipe(t)
+	root := uuid.NamespaceURL
+	_,e := c.Lookup(root,"nope")
+	if !errors.Is(e,fs.ErrNotExist) || !errors.Is(e,syscall.ENOENT) { t.Error("lookup",e) }
+	d,_ := c.HL_Mkdir(root,"d",0)
+	_,e = c.HL_Mkdir(root,"d",0)
+	if !errors.Is(e,fs.ErrExist) { t.Error("mkdir",e) }
+	sub,_ := c.HL_Mkdir(d,"sub",0)
+	e = c.HL_Movelink(root,"d",sub,"d",0)
+	if !errors.Is(e,syscall.EINVAL) { t.Error("movelink",e) }
+	f,_ := c.HL_Mkfile(root,"f",0)
+	b,e := c.HL_ReadAt2(f,10,0)
+	if e!=io.EOF || len(b)!=0 { t.Error("read",b,e) }
+	_,e = c.(quickfs.XAttrFacade).GetXAttr(f,"user.q")
+	if !errors.Is(e,quickfs.ErrNoAttr) { t.Error("getxattr",e) }
+}
+
+// Nodes are created with the given attributes, and listed with theirs.
+func TestCreateAttr(t *testing.T) {
+	c := pipe(t)
+	root := uuid.NamespaceURL
+	f,e := c.HL_MkfileAttr(root,"f",0,&quickfs.NodeAttr{Mode:0640,Uid:7,Gid:8})
+	if e!=nil { t.Fatal(e) }
+	d,e := c.HL_MkdirAttr(root,"d",0,&quickfs.NodeAttr{Mode:0750,Uid:7,Gid:8})
+	if e!=nil { t.Fatal(e) }
+	c.WriteAt(f,[]byte("abc"),0)
+	ents,next,e := c.HL_ReadDirPlus(root,"",1)
+	if e!=nil || len(ents)!=1 || next!="d" { t.Fatal(ents,next,e) }
+	if ents[0].Name!="d" || *ents[0].Id!=*d || !ents[0].Stat.IsDir || ents[0].Stat.Mode!=0750 { t.Error(ents[0]) }
+	ents,next,e = c.HL_ReadDirPlus(root,next,1)
+	if e!=nil || len(ents)!=1 || next!="" { t.Fatal(ents,next,e) }
+	if st := ents[0].Stat; st.Size!=3 || st.Mode!=0640 || st.Uid!=7 || st.Gid!=8 { t.Error(st) }
+}
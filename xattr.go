@@ -0,0 +1,107 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "github.com/nu7hatch/gouuid"
+import "os"
+import "strings"
+import "syscall"
+
+// Flags of SetXAttr, as in setxattr(2).
+const (
+	// Fail with EEXIST, if the attribute exists.
+	XAttrCreate = 1
+	// Fail with ErrNoAttr, if the attribute doesn't exist.
+	XAttrReplace = 2
+)
+
+// Extended attributes of nodes. Missing attributes are reported as
+// ErrNoAttr.
+type XAttrFacade interface{
+	GetXAttr(id *uuid.UUID,name string) ([]byte,error)
+	SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error
+	ListXAttr(id *uuid.UUID) ([]string,error)
+	RemoveXAttr(id *uuid.UUID,name string) error
+}
+
+func (h *HL_Wrap) xattrs(op string,id *uuid.UUID) (XAttrFacade,error) {
+	x,ok := h.LL_Facade.(XAttrFacade)
+	if !ok { return nil,&os.PathError{Op:op,Path:id.String(),Err:syscall.ENOTSUP} }
+	return x,nil
+}
+func (h *HL_Wrap) GetXAttr(id *uuid.UUID,name string) ([]byte,error) {
+	x,e := h.xattrs("getxattr",id)
+	if e!=nil { return nil,e }
+	return x.GetXAttr(id,name)
+}
+func (h *HL_Wrap) SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error {
+	x,e := h.xattrs("setxattr",id)
+	if e!=nil { return e }
+	return x.SetXAttr(id,name,data,flags)
+}
+func (h *HL_Wrap) ListXAttr(id *uuid.UUID) ([]string,error) {
+	x,e := h.xattrs("listxattr",id)
+	if e!=nil { return nil,e }
+	return x.ListXAttr(id)
+}
+func (h *HL_Wrap) RemoveXAttr(id *uuid.UUID,name string) error {
+	x,e := h.xattrs("removexattr",id)
+	if e!=nil { return e }
+	return x.RemoveXAttr(id,name)
+}
+
+// The attributes of a node are stored as native xattrs of its file, named
+// xattrPrefix+name, so they don't clash with the node metadata.
+const xattrPrefix = metaPrefix+"x."
+
+func xattrErr(op,fn string,e error) error {
+	if e==nil { return nil }
+	return &os.PathError{Op:op,Path:fn,Err:e}
+}
+func (fs *FileSystem) GetXAttr(id *uuid.UUID,name string) ([]byte,error) {
+	fn := fs.extrude(id)
+	b,e := getxattr(fn,xattrPrefix+name)
+	return b,xattrErr("getxattr",fn,e)
+}
+func (fs *FileSystem) SetXAttr(id *uuid.UUID,name string,data []byte,flags int) error {
+	fn := fs.extrude(id)
+	return xattrErr("setxattr",fn,setxattr(fn,xattrPrefix+name,data,flags))
+}
+func (fs *FileSystem) ListXAttr(id *uuid.UUID) ([]string,error) {
+	fn := fs.extrude(id)
+	all,e := listxattr(fn)
+	if e!=nil { return nil,xattrErr("listxattr",fn,e) }
+	names := []string{}
+	for _,n := range all {
+		if strings.HasPrefix(n,xattrPrefix) { names = append(names,n[len(xattrPrefix):]) }
+	}
+	return names,nil
+}
+func (fs *FileSystem) RemoveXAttr(id *uuid.UUID,name string) error {
+	fn := fs.extrude(id)
+	return xattrErr("removexattr",fn,removexattr(fn,xattrPrefix+name))
+}
+
@@ -0,0 +1,65 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package quickfs
+
+import "bytes"
+import "syscall"
+
+func getxattr(path,name string) ([]byte,error) {
+	for {
+		n,e := syscall.Getxattr(path,name,nil)
+		if e!=nil { return nil,e }
+		buf := make([]byte,n)
+		m,e := syscall.Getxattr(path,name,buf)
+		if e==syscall.ERANGE { continue }
+		if e!=nil { return nil,e }
+		return buf[:m],nil
+	}
+}
+func setxattr(path,name string,data []byte,flags int) error {
+	return syscall.Setxattr(path,name,data,flags)
+}
+func listxattr(path string) ([]string,error) {
+	for {
+		n,e := syscall.Listxattr(path,nil)
+		if e!=nil { return nil,e }
+		buf := make([]byte,n)
+		m,e := syscall.Listxattr(path,buf)
+		if e==syscall.ERANGE { continue }
+		if e!=nil { return nil,e }
+		var names []string
+		for _,b := range bytes.Split(buf[:m],[]byte{0}) {
+			if len(b)>0 { names = append(names,string(b)) }
+		}
+		return names,nil
+	}
+}
+func removexattr(path,name string) error {
+	return syscall.Removexattr(path,name)
+}
+func xattrUnsupported(e error) bool {
+	return e==syscall.ENOTSUP
+}